@@ -0,0 +1,206 @@
+// Package client lets other Mattermost plugins look up people in the Pingboard directory
+// resolved by the Pingboard plugin, through the inter-plugin HTTP API. The calling
+// plugin's ID must be listed in the Pingboard plugin's configuration.
+//
+//	directory := client.New(p.API)
+//	user, err := directory.GetUser(userId)
+//	if errors.Is(err, client.ErrNotFound) {
+//		// not in Pingboard, or the Pingboard plugin is not running
+//	}
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// PluginId is the ID of the Pingboard plugin.
+const PluginId = "com.imc.mattermost-plugin-pingboard"
+
+const apiPath = "/" + PluginId + "/api/v1/plugin"
+
+// ErrNotFound is returned when the user or department is not in the directory, or there
+// is no directory data yet.
+var ErrNotFound = errors.New("not found in the pingboard directory")
+
+// PluginAPI is the part of the Mattermost plugin API the client needs; plugin.API has it.
+type PluginAPI interface {
+	PluginHTTP(request *http.Request) *http.Response
+}
+
+// User is a user's data from Pingboard. Users are identified by their Mattermost user ID
+// and username.
+type User struct {
+	PingboardId string `json:"id"`
+	Email       string `json:"email"`
+	FirstName   string `json:"first_name"`
+	LastName    string `json:"last_name"`
+	Nickname    string `json:"nickname"` // the preferred name in Pingboard
+	Url         string `json:"url"`      // the Pingboard profile
+	StartYear   int    `json:"start_year"`
+	StartMonth  int    `json:"start_month"`
+	StartDay    int    `json:"start_day"`
+	Phone       string `json:"phone"`
+	JobTitle    string `json:"job_title"`
+	Department  string `json:"department"`
+	Location    string `json:"location"`
+	ManagerId   string `json:"manager_id"` // Mattermost user ID of the manager, if they are a Mattermost user
+	Manager     string `json:"manager"`    // manager's username
+}
+
+type UserRef struct {
+	UserId   string `json:"user_id"`
+	Username string `json:"username"`
+}
+
+type Users struct {
+	Users    map[string]User `json:"users"` // by the user ID or username they were requested by
+	NotFound []string        `json:"not_found"`
+}
+
+type Chain struct {
+	User  UserRef   `json:"user"`
+	Chain []UserRef `json:"chain"` // immediate manager first
+	Cycle bool      `json:"cycle"` // the chain loops back on itself, and was cut at the first repeated user
+}
+
+type Reports struct {
+	User            UserRef   `json:"user"`
+	DirectReports   []UserRef `json:"direct_reports"`
+	IndirectReports []UserRef `json:"indirect_reports"`
+}
+
+type Department struct {
+	Name      string   `json:"name"`
+	Headcount int      `json:"headcount"`
+	Head      *UserRef `json:"head"`
+}
+
+type DepartmentMembers struct {
+	Name    string    `json:"name"`
+	Head    *UserRef  `json:"head"`
+	Members []UserRef `json:"members"`
+}
+
+// Client makes requests to the Pingboard plugin on behalf of another plugin.
+type Client struct {
+	api PluginAPI
+}
+
+func New(api PluginAPI) *Client {
+	return &Client{api: api}
+}
+
+// GetUser returns the user's data by Mattermost user ID.
+func (c *Client) GetUser(userId string) (*User, error) {
+	var user User
+	if err := c.do(http.MethodGet, "/user", url.Values{"user_id": {userId}}, nil, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// GetUserByUsername returns the user's data by Mattermost username.
+func (c *Client) GetUserByUsername(username string) (*User, error) {
+	var user User
+	if err := c.do(http.MethodGet, "/user", url.Values{"username": {username}}, nil, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// GetUsers looks up many users at once, by Mattermost user ID and/or username.
+func (c *Client) GetUsers(userIds []string, usernames []string) (*Users, error) {
+	request := struct {
+		UserIds   []string `json:"user_ids"`
+		Usernames []string `json:"usernames"`
+	}{UserIds: userIds, Usernames: usernames}
+	var users Users
+	if err := c.do(http.MethodPost, "/users", nil, request, &users); err != nil {
+		return nil, err
+	}
+	return &users, nil
+}
+
+// GetManagementChain returns the user's managers, immediate manager first.
+func (c *Client) GetManagementChain(userId string) (*Chain, error) {
+	var chain Chain
+	if err := c.do(http.MethodGet, "/user/chain", url.Values{"user_id": {userId}}, nil, &chain); err != nil {
+		return nil, err
+	}
+	return &chain, nil
+}
+
+// GetReports returns the user's direct reports, and everyone below them.
+func (c *Client) GetReports(userId string) (*Reports, error) {
+	var reports Reports
+	if err := c.do(http.MethodGet, "/user/reports", url.Values{"user_id": {userId}}, nil, &reports); err != nil {
+		return nil, err
+	}
+	return &reports, nil
+}
+
+// GetDepartments returns all departments, by name.
+func (c *Client) GetDepartments() ([]Department, error) {
+	departments := []Department{}
+	if err := c.do(http.MethodGet, "/departments", nil, nil, &departments); err != nil {
+		return nil, err
+	}
+	return departments, nil
+}
+
+// GetDepartmentMembers returns the members of the department with the given name, which
+// is matched ignoring case.
+func (c *Client) GetDepartmentMembers(name string) (*DepartmentMembers, error) {
+	var members DepartmentMembers
+	if err := c.do(http.MethodGet, "/departments/"+url.PathEscape(name)+"/members", nil, nil, &members); err != nil {
+		return nil, err
+	}
+	return &members, nil
+}
+
+func (c *Client) do(method string, path string, query url.Values, body interface{}, result interface{}) error {
+	var bodyReader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		bodyReader = bytes.NewReader(b)
+	}
+	requestUrl := apiPath + path
+	if len(query) > 0 {
+		requestUrl += "?" + query.Encode()
+	}
+	request, err := http.NewRequest(method, requestUrl, bodyReader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		request.Header.Set("Content-Type", "application/json")
+	}
+
+	response := c.api.PluginHTTP(request)
+	if response == nil {
+		return errors.New("pingboard plugin did not respond")
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		var apiError struct {
+			Error     string `json:"error"`
+			RequestId string `json:"request_id"`
+		}
+		_ = json.NewDecoder(response.Body).Decode(&apiError)
+		if response.StatusCode == http.StatusNotFound {
+			return ErrNotFound
+		}
+		return fmt.Errorf("pingboard plugin returned %d: %s (request %s)", response.StatusCode, apiError.Error, apiError.RequestId)
+	}
+	return json.NewDecoder(response.Body).Decode(result)
+}
@@ -0,0 +1,59 @@
+package client
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+type fakePluginAPI struct {
+	handler http.HandlerFunc
+}
+
+func (api fakePluginAPI) PluginHTTP(request *http.Request) *http.Response {
+	recorder := httptest.NewRecorder()
+	api.handler(recorder, request)
+	return recorder.Result()
+}
+
+func TestClient(t *testing.T) {
+	var requested string
+	directory := New(fakePluginAPI{handler: func(w http.ResponseWriter, r *http.Request) {
+		requested = r.Method + " " + r.URL.EscapedPath() + "?" + r.URL.RawQuery
+		switch r.URL.Path {
+		case "/com.imc.mattermost-plugin-pingboard/api/v1/plugin/user":
+			_, _ = w.Write([]byte(`{"id": "42", "department": "Trading", "manager_id": "m1", "manager": "bob"}`))
+		case "/com.imc.mattermost-plugin-pingboard/api/v1/plugin/departments/Sales/EU/members":
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"error": "not found", "request_id": "r1"}`))
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(`{"error": "failed to get user", "request_id": "r2"}`))
+		}
+	}})
+
+	user, err := directory.GetUser("u1")
+	if err != nil || user.PingboardId != "42" || user.Department != "Trading" || user.Manager != "bob" {
+		t.Logf("expected user, got %+v, %v", user, err)
+		t.Fail()
+	}
+	if expected := "GET /com.imc.mattermost-plugin-pingboard/api/v1/plugin/user?user_id=u1"; requested != expected {
+		t.Logf("expected request %s, got %s", expected, requested)
+		t.Fail()
+	}
+
+	if _, err := directory.GetDepartmentMembers("Sales/EU"); !errors.Is(err, ErrNotFound) {
+		t.Logf("expected not found, got %v", err)
+		t.Fail()
+	}
+	if expected := "GET /com.imc.mattermost-plugin-pingboard/api/v1/plugin/departments/Sales%2FEU/members?"; requested != expected {
+		t.Logf("expected request %s, got %s", expected, requested)
+		t.Fail()
+	}
+
+	if _, err := directory.GetReports("u1"); err == nil || errors.Is(err, ErrNotFound) {
+		t.Logf("expected an error, got %v", err)
+		t.Fail()
+	}
+}
@@ -2,18 +2,29 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
+	"math"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
 
+	"github.com/mattermost/mattermost/server/public/model"
 	"github.com/mattermost/mattermost/server/public/plugin"
 )
 
+// maxBatchUsers is the most users that can be looked up in a single request.
+const maxBatchUsers = 500
+
+// writeApiError writes an error response. Every error response has the same form, and
+// carries the request ID so that it can be found in the logs.
 func (p *Plugin) writeApiError(w http.ResponseWriter, statusCode int, message string) {
 	type Error struct {
-		Error string `json:"error"`
+		Error     string `json:"error"`
+		RequestId string `json:"request_id,omitempty"`
 	}
 	w.WriteHeader(statusCode)
-	b, err := json.Marshal(Error{Error: message})
+	b, err := json.Marshal(Error{Error: message, RequestId: w.Header().Get(requestIdHeader)})
 	if err != nil {
 		p.API.LogError("Failed to encode api error", "err", err)
 		return
@@ -24,6 +35,16 @@ func (p *Plugin) writeApiError(w http.ResponseWriter, statusCode int, message st
 	}
 }
 
+// requireSystemAdmin checks that the request was made by a system admin. If not, an
+// error response has already been written.
+func (p *Plugin) requireSystemAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if !p.API.HasPermissionTo(r.Header.Get("Mattermost-User-ID"), model.PermissionManageSystem) {
+		p.writeApiError(w, http.StatusForbidden, "only available to system admins")
+		return false
+	}
+	return true
+}
+
 func (p *Plugin) writeApiResponse(w http.ResponseWriter, v interface{}) {
 	b, err := json.Marshal(v)
 	if err != nil {
@@ -38,47 +59,503 @@ func (p *Plugin) writeApiResponse(w http.ResponseWriter, v interface{}) {
 	}
 }
 
+// requestedUserId returns the mattermost user ID given in the request's query, either
+// directly as user_id or as a username. If that fails, an error response has already
+// been written.
+func (p *Plugin) requestedUserId(w http.ResponseWriter, r *http.Request) (string, bool) {
+	query := r.URL.Query()
+	userIds, byUserId := query["user_id"]
+	usernames, byUsername := query["username"]
+	if byUserId && !byUsername && len(userIds) == 1 {
+		return userIds[0], true
+	}
+	if !byUsername || byUserId || len(usernames) != 1 {
+		p.API.LogDebug("Returning bad request (malformed user param)", "user_ids", userIds, "usernames", usernames)
+		p.writeApiError(w, http.StatusBadRequest, "specify one user_id or username")
+		return "", false
+	}
+
+	username := strings.ToLower(usernames[0])
+	mmUser, appErr := p.API.GetUserByUsername(username)
+	if appErr != nil {
+		if appErr.StatusCode == http.StatusNotFound {
+			p.API.LogDebug("Returning not found for " + username + " (unknown mattermost user)")
+			p.writeApiError(w, http.StatusNotFound, "not found")
+			return "", false
+		}
+		p.API.LogError("Failed to get mattermost user", "username", username, "error", appErr)
+		p.writeApiError(w, http.StatusInternalServerError, "failed to get user")
+		return "", false
+	}
+	return mmUser.Id, true
+}
+
+// lookupUser resolves the single user given in the request's query to a user in the
+// directory, with only the fields the viewer can see. Users the viewer can see nothing of
+// are not found. If that fails, an error response has already been written.
+func (p *Plugin) lookupUser(w http.ResponseWriter, r *http.Request, v *viewer) (*directory, string, User, bool) {
+	userId, ok := p.requestedUserId(w, r)
+	if !ok {
+		return nil, "", User{}, false
+	}
+
+	dir := p.getDirectory()
+	if dir == nil {
+		p.API.LogDebug("Returning not found for " + userId + " (no pingboard data)")
+		p.writeApiError(w, http.StatusNotFound, "not found")
+		return nil, "", User{}, false
+	}
+	user, found := dir.user(userId)
+	if !found {
+		p.API.LogDebug("Returning not found for " + userId + " (unknown pingboard user)")
+		p.writeApiError(w, http.StatusNotFound, "not found")
+		return nil, "", User{}, false
+	}
+	user, visible := v.filterUser(dir, userId, user)
+	if !visible {
+		p.API.LogDebug("Returning not found for " + userId + " (not visible to " + v.userId + ")")
+		p.writeApiError(w, http.StatusNotFound, "not found")
+		return nil, "", User{}, false
+	}
+	return dir, userId, user, true
+}
+
+// presentUser prepares a user from the directory, already filtered for the viewer, to be
+// returned by the API.
+func presentUser(user User, usernames *usernameCache) User {
+	if user.ManagerId != "" {
+		user.Manager = usernames.username(user.ManagerId)
+	}
+	return user
+}
+
 func (p *Plugin) handleGetUser(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		http.NotFound(w, r)
+	_, userId, user, ok := p.lookupUser(w, r, p.newViewer(r))
+	if !ok {
 		return
 	}
+	user = presentUser(user, p.newUsernameCache())
+	p.auditLookups(r, map[string]User{userId: user})
+	p.API.LogDebug("Returning user data for " + userId)
+	p.writeApiResponse(w, user)
+}
+
+// handlePostUsers looks up many users at once. Users are returned keyed by the user ID or
+// (lowercase) username they were requested by; those that are unknown, to Mattermost or
+// to Pingboard, or that the viewer can see nothing of, are listed as not found.
+// uniqueStrings returns the values without repeats, in the order first given.
+func uniqueStrings(values []string) []string {
+	unique := make([]string, 0, len(values))
+	seen := map[string]bool{}
+	for _, value := range values {
+		if !seen[value] {
+			seen[value] = true
+			unique = append(unique, value)
+		}
+	}
+	return unique
+}
 
-	usernames, ok := r.URL.Query()["username"]
-	if !ok || len(usernames) != 1 {
-		p.API.LogDebug("Returning bad request (malformed username param)", "usernames", usernames)
-		p.writeApiError(w, http.StatusBadRequest, "specify one username")
+func (p *Plugin) handlePostUsers(w http.ResponseWriter, r *http.Request) {
+	type Request struct {
+		UserIds   []string `json:"user_ids"`
+		Usernames []string `json:"usernames"`
+	}
+	type Users struct {
+		Users    map[string]User `json:"users"`
+		NotFound []string        `json:"not_found"`
+	}
+	var request Request
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		p.API.LogDebug("Returning bad request (malformed users request)", "error", err)
+		p.writeApiError(w, http.StatusBadRequest, "expected user_ids and/or usernames")
 		return
 	}
-	username := strings.ToLower(usernames[0])
+	for i, username := range request.Usernames {
+		request.Usernames[i] = strings.ToLower(username)
+	}
+	request.UserIds = uniqueStrings(request.UserIds)
+	request.Usernames = uniqueStrings(request.Usernames)
+	if count := len(request.UserIds) + len(request.Usernames); count > maxBatchUsers {
+		p.API.LogDebug(fmt.Sprintf("Returning bad request (%d users requested)", count))
+		p.writeApiError(w, http.StatusBadRequest, fmt.Sprintf("specify at most %d users", maxBatchUsers))
+		return
+	}
+
+	// keys the users are requested by, by their mattermost user ID
+	keysByUserId := map[string][]string{}
+	result := Users{Users: map[string]User{}, NotFound: []string{}}
+	for _, userId := range request.UserIds {
+		keysByUserId[userId] = append(keysByUserId[userId], userId)
+	}
+	if len(request.Usernames) > 0 {
+		mmUsers, appErr := p.API.GetUsersByUsernames(request.Usernames)
+		if appErr != nil {
+			p.API.LogError("Failed to get mattermost users", "error", appErr)
+			p.writeApiError(w, http.StatusInternalServerError, "failed to get users")
+			return
+		}
+		found := map[string]bool{}
+		for _, mmUser := range mmUsers {
+			keysByUserId[mmUser.Id] = append(keysByUserId[mmUser.Id], mmUser.Username)
+			found[mmUser.Username] = true
+		}
+		for _, username := range request.Usernames {
+			if !found[username] {
+				result.NotFound = append(result.NotFound, username)
+			}
+		}
+	}
+
+	dir := p.getDirectory()
+	v := p.newViewer(r)
+	usernames := p.newUsernameCache()
+	returned := map[string]User{}
+	for userId, keys := range keysByUserId {
+		var user User
+		found := false
+		if dir != nil {
+			user, found = dir.user(userId)
+		}
+		if found {
+			user, found = v.filterUser(dir, userId, user)
+		}
+		if found {
+			user = presentUser(user, usernames)
+			returned[userId] = user
+		}
+		for _, key := range keys {
+			if found {
+				result.Users[key] = user
+			} else {
+				result.NotFound = append(result.NotFound, key)
+			}
+		}
+	}
+	sort.Strings(result.NotFound)
+	p.auditLookups(r, returned)
+
+	p.API.LogDebug(fmt.Sprintf("Returning data for %d users (%d not found)", len(result.Users), len(result.NotFound)))
+	p.writeApiResponse(w, result)
+}
+
+func (p *Plugin) handleGetChain(w http.ResponseWriter, r *http.Request) {
+	type Chain struct {
+		User  userRef   `json:"user"`
+		Chain []userRef `json:"chain"` // immediate manager first
+		Cycle bool      `json:"cycle"`
+	}
+	v := p.newViewer(r)
+	dir, userId, _, ok := p.lookupUser(w, r, v)
+	if !ok {
+		return
+	}
+	chain, cycle := dir.managementChain(userId)
+	if cycle {
+		p.API.LogWarn("Management chain contains a cycle", "user_id", userId, "chain", strings.Join(chain, ","))
+	}
+	if visible := v.visibleChain(dir, userId, chain); len(visible) < len(chain) {
+		chain = visible
+		cycle = false
+	}
+	if len(chain) > 0 {
+		// the chain shows the manager of the user and of everyone in it but the last
+		p.auditLookups(r, managerLookups(dir, append([]string{userId}, chain[:len(chain)-1]...)))
+	}
+	usernames := p.newUsernameCache()
+	p.API.LogDebug("Returning management chain for " + userId)
+	p.writeApiResponse(w, Chain{
+		User:  userRef{UserId: userId, Username: usernames.username(userId)},
+		Chain: usernames.refs(chain),
+		Cycle: cycle,
+	})
+}
+
+func (p *Plugin) handleGetReports(w http.ResponseWriter, r *http.Request) {
+	type Reports struct {
+		User            userRef   `json:"user"`
+		DirectReports   []userRef `json:"direct_reports"`
+		IndirectReports []userRef `json:"indirect_reports"`
+	}
+	v := p.newViewer(r)
+	dir, userId, _, ok := p.lookupUser(w, r, v)
+	if !ok {
+		return
+	}
+	directReports, indirectReports := v.visibleReports(dir, userId)
+	p.auditLookups(r, managerLookups(dir, append(append([]string{}, directReports...), indirectReports...)))
+	usernames := p.newUsernameCache()
+	p.API.LogDebug("Returning reports for " + userId)
+	p.writeApiResponse(w, Reports{
+		User:            userRef{UserId: userId, Username: usernames.username(userId)},
+		DirectReports:   usernames.refs(directReports),
+		IndirectReports: usernames.refs(indirectReports),
+	})
+}
 
-	if p.usersByUsername == nil {
-		p.API.LogDebug("Returning not found for " + username + " (no pingboard data)")
-		http.NotFound(w, r)
+// intParam returns the named query parameter as an int, or defaultValue if it is not
+// given. If it is not a number in [minValue, maxValue], an error response has already
+// been written.
+func (p *Plugin) intParam(w http.ResponseWriter, r *http.Request, name string, defaultValue int,
+	minValue int, maxValue int) (int, bool) {
+	param := r.URL.Query().Get(name)
+	if param == "" {
+		return defaultValue, true
+	}
+	value, err := strconv.Atoi(param)
+	if err != nil || value < minValue || value > maxValue {
+		p.API.LogDebug("Returning bad request (malformed "+name+" param)", name, param)
+		p.writeApiError(w, http.StatusBadRequest, fmt.Sprintf("%s must be a number from %d to %d", name, minValue, maxValue))
+		return 0, false
+	}
+	return value, true
+}
+
+func (p *Plugin) handleSearch(w http.ResponseWriter, r *http.Request) {
+	type Result struct {
+		UserId   string `json:"user_id"`
+		Username string `json:"username"`
+		User
+	}
+	type Results struct {
+		Total   int      `json:"total"`
+		Page    int      `json:"page"`
+		PerPage int      `json:"per_page"`
+		Results []Result `json:"results"`
+	}
+	page, ok := p.intParam(w, r, "page", 0, 0, math.MaxInt32)
+	if !ok {
+		return
+	}
+	perPage, ok := p.intParam(w, r, "per_page", 50, 1, 200)
+	if !ok {
+		return
+	}
+
+	dir := p.getDirectory()
+	if dir == nil {
+		p.API.LogDebug("Returning not found for search (no pingboard data)")
+		p.writeApiError(w, http.StatusNotFound, "not found")
 		return
 	}
-	user, found := p.usersByUsername[username]
+
+	// Only users the viewer could have found by what they can see are results
+	v := p.newViewer(r)
+	query := r.URL.Query()
+	search := searchQuery{
+		text:       query.Get("q"),
+		fuzzy:      query.Get("fuzzy") == "true",
+		department: query.Get("department"),
+		location:   query.Get("location"),
+		jobTitle:   query.Get("job_title"),
+		phone:      query.Get("phone"),
+		canSee: func(field string, userId string) bool {
+			return v.canSee(dir, field, userId)
+		},
+	}
+	userIds := dir.search.search(search)
+
+	fields := []string{visibleFieldName}
+	for field, filter := range map[string]string{
+		visibleFieldDepartment: search.department,
+		visibleFieldLocation:   search.location,
+		visibleFieldJobTitle:   search.jobTitle,
+		visibleFieldPhone:      search.phone,
+	} {
+		if filter != "" {
+			fields = append(fields, field)
+		}
+	}
+	userIds = v.filterUserIds(dir, userIds, fields...)
+
+	results := Results{Total: len(userIds), Page: page, PerPage: perPage, Results: []Result{}}
+	usernames := p.newUsernameCache()
+	returned := map[string]User{}
+	for i := page * perPage; i < len(userIds) && i < (page+1)*perPage; i++ {
+		user, _ := dir.user(userIds[i])
+		user, _ = v.filterUser(dir, userIds[i], user)
+		user = presentUser(user, usernames)
+		returned[userIds[i]] = user
+		results.Results = append(results.Results, Result{
+			UserId:   userIds[i],
+			Username: usernames.username(userIds[i]),
+			User:     user,
+		})
+	}
+	p.auditLookups(r, returned)
+	p.API.LogDebug(fmt.Sprintf("Returning %d of %d search results", len(results.Results), results.Total))
+	p.writeApiResponse(w, results)
+}
+
+func (p *Plugin) handleGetDepartments(w http.ResponseWriter, r *http.Request) {
+	type Department struct {
+		Name      string   `json:"name"`
+		Headcount int      `json:"headcount"`
+		Head      *userRef `json:"head,omitempty"` // unless not visible to the viewer
+	}
+	dir := p.getDirectory()
+	if dir == nil {
+		p.API.LogDebug("Returning not found for departments (no pingboard data)")
+		p.writeApiError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	// Departments are counted by the members whose department the viewer can see
+	v := p.newViewer(r)
+	usernames := p.newUsernameCache()
+	departments := []Department{}
+	headIds := []string{}
+	for _, dept := range dir.sortedDepartments() {
+		memberIds := v.filterUserIds(dir, dept.memberIds, visibleFieldDepartment)
+		if len(memberIds) == 0 {
+			continue
+		}
+		head := v.departmentHead(dir, dept, usernames)
+		if head != nil {
+			headIds = append(headIds, head.UserId)
+		}
+		departments = append(departments, Department{
+			Name:      dept.name,
+			Headcount: len(memberIds),
+			Head:      head,
+		})
+	}
+	p.auditLookups(r, departmentLookups(dir, headIds))
+	p.API.LogDebug(fmt.Sprintf("Returning %d departments", len(departments)))
+	p.writeApiResponse(w, departments)
+}
+
+func (p *Plugin) handleGetDepartmentMembers(w http.ResponseWriter, r *http.Request) {
+	type Members struct {
+		Name    string    `json:"name"`
+		Head    *userRef  `json:"head,omitempty"` // unless not visible to the viewer
+		Members []userRef `json:"members"`
+	}
+	name := pathParam(r, "name")
+
+	dir := p.getDirectory()
+	if dir == nil {
+		p.API.LogDebug("Returning not found for department " + name + " (no pingboard data)")
+		p.writeApiError(w, http.StatusNotFound, "not found")
+		return
+	}
+	dept, found := dir.departments[strings.ToLower(name)]
 	if !found {
-		p.API.LogDebug("Returning not found for " + username + " (unknown pingboard user)")
-		http.NotFound(w, r)
+		p.API.LogDebug("Returning not found for department " + name + " (unknown department)")
+		p.writeApiError(w, http.StatusNotFound, "not found")
 		return
 	}
-	p.API.LogDebug("Returning user data for " + username)
-	p.writeApiResponse(w, user)
+
+	v := p.newViewer(r)
+	memberIds := v.filterUserIds(dir, dept.memberIds, visibleFieldDepartment)
+	if len(memberIds) == 0 {
+		p.API.LogDebug("Returning not found for department " + name + " (no members visible to " + v.userId + ")")
+		p.writeApiError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	p.auditLookups(r, departmentLookups(dir, memberIds))
+	usernames := p.newUsernameCache()
+	p.API.LogDebug("Returning members of department " + dept.name)
+	p.writeApiResponse(w, Members{
+		Name:    dept.name,
+		Head:    v.departmentHead(dir, dept, usernames),
+		Members: usernames.refs(memberIds),
+	})
 }
 
-func (p *Plugin) ServeHTTP(_ *plugin.Context, w http.ResponseWriter, r *http.Request) {
-	if userID := r.Header.Get("Mattermost-User-ID"); userID == "" {
-		http.Error(w, "Not authorized", http.StatusUnauthorized)
+// fillOrgChartUsernames fills in the usernames of everyone in the trees, looking them
+// up together.
+func fillOrgChartUsernames(tree []*orgChartNode, usernames *usernameCache) {
+	nodes := []*orgChartNode{}
+	queue := tree
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = append(queue[1:], node.Reports...)
+		nodes = append(nodes, node)
+	}
+	userIds := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		userIds = append(userIds, node.UserId)
+	}
+	usernames.load(userIds)
+	for _, node := range nodes {
+		node.Username = usernames.username(node.UserId)
+	}
+}
+
+func (p *Plugin) handleGetOrgChart(w http.ResponseWriter, r *http.Request) {
+	type OrgChart struct {
+		Tree    []*orgChartNode `json:"tree"`
+		Roots   []userRef       `json:"roots"`
+		Orphans []userRef       `json:"orphans"`
+		Cycles  []userRef       `json:"cycles"` // one user from each loop in the reporting lines
+	}
+	query := r.URL.Query()
+	depth, ok := p.intParam(w, r, "depth", 0, 0, math.MaxInt32)
+	if !ok {
 		return
 	}
 
+	dir := p.getDirectory()
+	if dir == nil {
+		p.API.LogDebug("Returning not found for org chart (no pingboard data)")
+		p.writeApiError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	// Without a user, the tree is rooted at everyone who has no manager above them, as far
+	// as the viewer can see
+	v := p.newViewer(r)
+	roots := v.filterUserIds(dir, dir.roots, visibleFieldManager)
+	orphans := v.filterUserIds(dir, dir.orphans, visibleFieldManager)
+	cycles := v.filterUserIds(dir, dir.cycles, visibleFieldManager)
+	rootUserIds := append(append(append([]string{}, roots...), orphans...), cycles...)
+	if query.Has("user_id") || query.Has("username") {
+		userId, ok := p.requestedUserId(w, r)
+		if !ok {
+			return
+		}
+		user, found := dir.user(userId)
+		if !found {
+			p.API.LogDebug("Returning not found for org chart of " + userId + " (unknown pingboard user)")
+			p.writeApiError(w, http.StatusNotFound, "not found")
+			return
+		}
+		if _, visible := v.filterUser(dir, userId, user); !visible {
+			p.API.LogDebug("Returning not found for org chart of " + userId + " (not visible to " + v.userId + ")")
+			p.writeApiError(w, http.StatusNotFound, "not found")
+			return
+		}
+		rootUserIds = []string{userId}
+	}
+
+	usernames := p.newUsernameCache()
+	tree := []*orgChartNode{}
+	for _, userId := range rootUserIds {
+		node := dir.orgChart(userId, depth)
+		v.filterOrgChart(dir, node)
+		tree = append(tree, node)
+	}
+	fillOrgChartUsernames(tree, usernames)
+	p.auditLookups(r, orgChartLookups(tree))
+	p.API.LogDebug(fmt.Sprintf("Returning org chart with %d roots (depth %d)", len(tree), depth))
+	p.writeApiResponse(w, OrgChart{Tree: tree, Roots: usernames.refs(roots), Orphans: usernames.refs(orphans),
+		Cycles: usernames.refs(cycles)})
+}
+
+func (p *Plugin) ServeHTTP(_ *plugin.Context, w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(requestIdHeader, requestId(r))
 
-	switch path := r.URL.Path; path {
-	case "/user":
-		p.handleGetUser(w, r)
-	default:
-		http.NotFound(w, r)
+	// Requests to the unversioned paths of earlier releases are served as v1
+	path := r.URL.EscapedPath()
+	if !strings.HasPrefix(path, "/api/") {
+		path = apiV1Prefix + path
+	}
+	if !strings.HasPrefix(path, apiV1Prefix+"/") {
+		p.writeApiError(w, http.StatusNotFound, "not found")
+		return
 	}
+	p.serveApi(w, r, strings.TrimPrefix(path, apiV1Prefix))
 }
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestPostUsersRepeated(t *testing.T) {
+	api := &plugintest.API{}
+	api.On("GetUsersByUsernames", []string{"bob", "carol"}).Return([]*model.User{{Id: "bob", Username: "bob"}}, nil).Once()
+	api.On("LogDebug", mock.Anything).Maybe()
+	p := &Plugin{}
+	p.SetAPI(api)
+	p.directory = newDirectory(map[string]User{"alice": {JobTitle: "Engineer"}, "bob": {JobTitle: "Manager"}})
+
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/users", bytes.NewBufferString(
+		`{"user_ids": ["alice", "nobody", "alice", "nobody"], "usernames": ["Bob", "carol", "bob", "Carol"]}`))
+	r.Header.Set(pluginIdHeader, "com.example.other")
+	w := httptest.NewRecorder()
+	p.handlePostUsers(w, r)
+	api.AssertExpectations(t)
+
+	var result struct {
+		Users    map[string]User `json:"users"`
+		NotFound []string        `json:"not_found"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+		t.Logf("expected a users response, got %d: %s", w.Code, w.Body)
+		t.FailNow()
+	}
+	if len(result.Users) != 2 || result.Users["alice"].JobTitle != "Engineer" || result.Users["bob"].JobTitle != "Manager" {
+		t.Logf("expected alice and bob, got %v", result.Users)
+		t.Fail()
+	}
+	if expected := []string{"carol", "nobody"}; !reflect.DeepEqual(result.NotFound, expected) {
+		t.Logf("expected not found %v, got %v", expected, result.NotFound)
+		t.Fail()
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strings"
+)
+
+// How long clients may use a response before checking whether it is still current.
+// Kept short, since usernames are looked up when the response is made.
+const directoryCacheMaxAge = 60
+
+// bufferedResponse holds back a response, so that its ETag can be computed from the
+// body before anything is written.
+type bufferedResponse struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (b *bufferedResponse) WriteHeader(status int) {
+	b.status = status
+}
+
+func (b *bufferedResponse) Write(data []byte) (int, error) {
+	return b.body.Write(data)
+}
+
+// responseETag returns the ETag of a response body. Responses made from the directory
+// depend on the viewer (their role and teams as well as who they are), the visibility
+// settings and usernames looked up when the response is made, so only the body itself
+// tells whether the client's copy is still current.
+func responseETag(body []byte) string {
+	hash := fnv.New64a()
+	_, _ = hash.Write(body)
+	return fmt.Sprintf(`"%x"`, hash.Sum64())
+}
+
+// serveCacheable serves a response made from the directory with caching headers. If the
+// request shows that the client already has that response, it writes a 304 Not Modified
+// response instead. Error responses are written as they are, without caching headers.
+func (p *Plugin) serveCacheable(w http.ResponseWriter, r *http.Request, handler http.HandlerFunc) {
+	buffered := &bufferedResponse{ResponseWriter: w, status: http.StatusOK}
+	handler(buffered, r)
+	body := buffered.body.Bytes()
+	if buffered.status != http.StatusOK {
+		w.WriteHeader(buffered.status)
+		_, _ = w.Write(body)
+		return
+	}
+
+	etag := responseETag(body)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", fmt.Sprintf("private, max-age=%d", directoryCacheMaxAge))
+	for _, candidate := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+	_, _ = w.Write(body)
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestServeCacheable(t *testing.T) {
+	p := &Plugin{}
+	for name, tc := range map[string]struct {
+		status         int
+		body           string
+		ifNoneMatch    string
+		expectedStatus int
+		expectedBody   string
+		expectedETag   bool
+	}{
+		"no cached copy": {
+			status: http.StatusOK, body: `{"id":"1"}`,
+			expectedStatus: http.StatusOK, expectedBody: `{"id":"1"}`, expectedETag: true,
+		},
+		"cached copy still current": {
+			status: http.StatusOK, body: `{"id":"1"}`, ifNoneMatch: responseETag([]byte(`{"id":"1"}`)),
+			expectedStatus: http.StatusNotModified, expectedBody: "", expectedETag: true,
+		},
+		"weak tag among others": {
+			status: http.StatusOK, body: `{"id":"1"}`, ifNoneMatch: `"x", W/` + responseETag([]byte(`{"id":"1"}`)),
+			expectedStatus: http.StatusNotModified, expectedBody: "", expectedETag: true,
+		},
+		"cached copy out of date": {
+			status: http.StatusOK, body: `{"id":"1","manager":"renamed"}`, ifNoneMatch: responseETag([]byte(`{"id":"1"}`)),
+			expectedStatus: http.StatusOK, expectedBody: `{"id":"1","manager":"renamed"}`, expectedETag: true,
+		},
+		"error": {
+			status: http.StatusNotFound, body: `{"error":"not found"}`, ifNoneMatch: responseETag([]byte(`{"error":"not found"}`)),
+			expectedStatus: http.StatusNotFound, expectedBody: `{"error":"not found"}`, expectedETag: false,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/api/v1/user", nil)
+			if tc.ifNoneMatch != "" {
+				r.Header.Set("If-None-Match", tc.ifNoneMatch)
+			}
+			w := httptest.NewRecorder()
+			p.serveCacheable(w, r, func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tc.status)
+				_, _ = w.Write([]byte(tc.body))
+			})
+			if w.Code != tc.expectedStatus || w.Body.String() != tc.expectedBody {
+				t.Logf("expected %d %q, got %d %q", tc.expectedStatus, tc.expectedBody, w.Code, w.Body.String())
+				t.Fail()
+			}
+			if hasETag := w.Header().Get("ETag") != ""; hasETag != tc.expectedETag || (w.Header().Get("Cache-Control") != "") != tc.expectedETag {
+				t.Logf("expected caching headers %v, got %v", tc.expectedETag, w.Header())
+				t.Fail()
+			}
+		})
+	}
+}
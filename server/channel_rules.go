@@ -0,0 +1,480 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+const (
+	channelRulesModeOff  = "off"
+	channelRulesModeAdd  = "add"
+	channelRulesModeSync = "sync"
+)
+
+const (
+	// The audit log is kept in one key per day, e.g. channel_rules_audit_20240601
+	channelRulesAuditKeyPrefix     = "channel_rules_audit_"
+	channelRulesAuditKeyTimeFormat = "20060102"
+	channelRulesAuditDays          = 30
+
+	// Most changes kept for one day; any more are only logged
+	channelRulesAuditMaxDayEntries = 5000
+
+	// The users the rules added to each channel, as only they are removed in full sync mode
+	channelRulesAddedKey = "channel_rules_added"
+)
+
+// channelRulesAdded holds the IDs of the users the rules added, by channel ID.
+type channelRulesAdded map[string]map[string]bool
+
+// apply records users added to (true) or forgotten from (false) channels. If keepChannelIds
+// is given, other channels are forgotten entirely, as no rule adds users to them any more.
+func (added channelRulesAdded) apply(changes channelRulesAdded, keepChannelIds map[string]bool) {
+	for channelId, userChanges := range changes {
+		for userId, isAdded := range userChanges {
+			if !isAdded {
+				delete(added[channelId], userId)
+				continue
+			}
+			if added[channelId] == nil {
+				added[channelId] = map[string]bool{}
+			}
+			added[channelId][userId] = true
+		}
+	}
+	for channelId, userIds := range added {
+		if len(userIds) == 0 || (keepChannelIds != nil && !keepChannelIds[channelId]) {
+			delete(added, channelId)
+		}
+	}
+}
+
+// channelRule adds users whose attribute has the given value to a channel, e.g.
+// "department = Trading -> main/trading-floor".
+type channelRule struct {
+	attribute   string
+	value       string
+	teamName    string
+	channelName string
+}
+
+func (r channelRule) String() string {
+	return fmt.Sprintf("%s = %s -> %s/%s", r.attribute, r.value, r.teamName, r.channelName)
+}
+
+func (r channelRule) matches(user User) bool {
+	value, _ := userAttribute(user, r.attribute)
+	return value != "" && strings.EqualFold(value, r.value)
+}
+
+// userAttribute returns the value of a user attribute by the name used in rules.
+func userAttribute(user User, attribute string) (string, bool) {
+	switch attribute {
+	case "department":
+		return user.Department, true
+	case "location":
+		return user.Location, true
+	case "job_title":
+		return user.JobTitle, true
+	}
+	return "", false
+}
+
+// parseChannelRules parses rules given one per line. Blank lines and lines starting
+// with # are ignored; any other line that is not a valid rule is an error.
+func parseChannelRules(text string) ([]channelRule, error) {
+	rules := []channelRule{}
+	for i, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		condition, target, found := strings.Cut(line, "->")
+		if !found {
+			return nil, fmt.Errorf("line %d: expected 'attribute = value -> team/channel'", i+1)
+		}
+		attribute, value, found := strings.Cut(condition, "=")
+		if !found {
+			return nil, fmt.Errorf("line %d: expected 'attribute = value' before '->'", i+1)
+		}
+		teamName, channelName, found := strings.Cut(strings.TrimSpace(target), "/")
+		if !found {
+			return nil, fmt.Errorf("line %d: expected 'team/channel' after '->'", i+1)
+		}
+		rule := channelRule{
+			attribute:   strings.ToLower(strings.TrimSpace(attribute)),
+			value:       strings.TrimSpace(value),
+			teamName:    strings.TrimSpace(teamName),
+			channelName: strings.TrimPrefix(strings.TrimSpace(channelName), "~"),
+		}
+		if _, known := userAttribute(User{}, rule.attribute); !known {
+			return nil, fmt.Errorf("line %d: unknown attribute '%s'", i+1, rule.attribute)
+		}
+		if rule.value == "" || rule.teamName == "" || rule.channelName == "" {
+			return nil, fmt.Errorf("line %d: value, team and channel must not be empty", i+1)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+type membershipChange struct {
+	Time    time.Time `json:"time"`
+	UserId  string    `json:"user_id"`
+	Channel string    `json:"channel"` // team/channel
+	Action  string    `json:"action"`  // add or remove
+	Rule    string    `json:"rule"`    // the rule that was matched, when adding
+	DryRun  bool      `json:"dry_run"`
+	Error   string    `json:"error,omitempty"`
+}
+
+type channelRulesReport struct {
+	Time    time.Time          `json:"time"`
+	Mode    string             `json:"mode"`
+	DryRun  bool               `json:"dry_run"`
+	Changes []membershipChange `json:"changes"`
+	Errors  []string           `json:"errors"`
+}
+
+func (report *channelRulesReport) change(userId string, channel string, action string, rule string) *membershipChange {
+	report.Changes = append(report.Changes, membershipChange{
+		Time:    time.Now(),
+		UserId:  userId,
+		Channel: channel,
+		Action:  action,
+		Rule:    rule,
+		DryRun:  report.DryRun,
+	})
+	return &report.Changes[len(report.Changes)-1]
+}
+
+// channelLeavers returns the users the rules added to the channel who are still members
+// but no longer match any of its rules, in order. Users without Pingboard data are left
+// alone.
+func channelLeavers(dir *directory, rules []channelRule, added map[string]bool, memberIds map[string]bool) []string {
+	leavers := []string{}
+	for userId := range added {
+		user, found := dir.user(userId)
+		if !found || !memberIds[userId] {
+			continue
+		}
+		matched := false
+		for _, rule := range rules {
+			matched = matched || rule.matches(user)
+		}
+		if !matched {
+			leavers = append(leavers, userId)
+		}
+	}
+	sort.Strings(leavers)
+	return leavers
+}
+
+func (p *Plugin) getChannelRulesAdded() (channelRulesAdded, error) {
+	data, appErr := p.API.KVGet(channelRulesAddedKey)
+	if appErr != nil {
+		return nil, appErr
+	}
+	added := channelRulesAdded{}
+	if data == nil {
+		return added, nil
+	}
+	if err := json.Unmarshal(data, &added); err != nil {
+		return nil, err
+	}
+	return added, nil
+}
+
+// updateChannelRulesAdded applies changes to the record of users the rules added, on top
+// of any changes made meanwhile by other servers.
+func (p *Plugin) updateChannelRulesAdded(changes channelRulesAdded, keepChannelIds map[string]bool) error {
+	return p.kvUpdate(channelRulesAddedKey, 0, func(data []byte) ([]byte, error) {
+		added := channelRulesAdded{}
+		if data != nil {
+			if err := json.Unmarshal(data, &added); err != nil {
+				return nil, err
+			}
+		}
+		added.apply(changes, keepChannelIds)
+		return json.Marshal(added)
+	})
+}
+
+// channelMemberIds returns the IDs of all members of the channel.
+func (p *Plugin) channelMemberIds(channelId string) (map[string]bool, *model.AppError) {
+	memberIds := map[string]bool{}
+	for page := 0; ; page++ {
+		members, appErr := p.API.GetChannelMembers(channelId, page, 200)
+		if appErr != nil {
+			return nil, appErr
+		}
+		if len(members) == 0 {
+			return memberIds, nil
+		}
+		for _, member := range members {
+			memberIds[member.UserId] = true
+		}
+	}
+}
+
+// applyChannelRules adds (and in full sync mode, removes) channel members according to
+// the configured rules. Only members the rules added are ever removed. If userIds is
+// given, only those users are considered and nobody is removed.
+func (p *Plugin) applyChannelRules(dir *directory, userIds []string) {
+	config := p.getConfiguration()
+	if config.ChannelRulesMode != channelRulesModeAdd && config.ChannelRulesMode != channelRulesModeSync {
+		return
+	}
+
+	p.channelRulesLock.Lock()
+	defer p.channelRulesLock.Unlock()
+
+	report := &channelRulesReport{
+		Time:    time.Now(),
+		Mode:    config.ChannelRulesMode,
+		DryRun:  config.ChannelRulesDryRun,
+		Changes: []membershipChange{},
+		Errors:  []string{},
+	}
+	defer p.finishChannelRules(report, userIds == nil)
+
+	rules, err := parseChannelRules(config.ChannelRules)
+	if err != nil {
+		p.API.LogError("Invalid channel membership rules", "error", err)
+		report.Errors = append(report.Errors, err.Error())
+		return
+	}
+
+	added, err := p.getChannelRulesAdded()
+	if err != nil {
+		p.API.LogError("Channel membership rules: failed to read the users added", "error", err)
+		report.Errors = append(report.Errors, err.Error())
+		return
+	}
+	changes := channelRulesAdded{}
+	record := func(channelId string, userId string, isAdded bool) {
+		if changes[channelId] == nil {
+			changes[channelId] = map[string]bool{}
+		}
+		changes[channelId][userId] = isAdded
+	}
+	// after a run over all users, channels without rules are forgotten, unless some
+	// channel could not be found
+	var keepChannelIds map[string]bool
+	if userIds == nil {
+		keepChannelIds = map[string]bool{}
+	}
+	defer func() {
+		prune := false
+		for channelId := range added {
+			prune = prune || (keepChannelIds != nil && !keepChannelIds[channelId])
+		}
+		if len(changes) == 0 && !prune {
+			return
+		}
+		if err := p.updateChannelRulesAdded(changes, keepChannelIds); err != nil {
+			p.API.LogError("Channel membership rules: failed to record the users added", "error", err)
+		}
+	}()
+
+	removeLeavers := config.ChannelRulesMode == channelRulesModeSync && userIds == nil
+	if userIds == nil {
+		userIds = make([]string, 0, len(dir.usersById))
+		for userId := range dir.usersById {
+			userIds = append(userIds, userId)
+		}
+	}
+	sort.Strings(userIds)
+
+	rulesByChannel := map[string][]channelRule{}
+	channels := []string{}
+	for _, rule := range rules {
+		channel := rule.teamName + "/" + rule.channelName
+		if _, found := rulesByChannel[channel]; !found {
+			channels = append(channels, channel)
+		}
+		rulesByChannel[channel] = append(rulesByChannel[channel], rule)
+	}
+
+	for _, channel := range channels {
+		channelRules := rulesByChannel[channel]
+		mmChannel, appErr := p.API.GetChannelByNameForTeamName(channelRules[0].teamName, channelRules[0].channelName, false)
+		if appErr != nil {
+			p.API.LogError("Channel membership rules: failed to get channel", "channel", channel, "error", appErr)
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %s", channel, appErr.Error()))
+			keepChannelIds = nil
+			continue
+		}
+		if keepChannelIds != nil {
+			keepChannelIds[mmChannel.Id] = true
+		}
+		memberIds, appErr := p.channelMemberIds(mmChannel.Id)
+		if appErr != nil {
+			p.API.LogError("Channel membership rules: failed to get channel members", "channel", channel, "error", appErr)
+			report.Errors = append(report.Errors, fmt.Sprintf("%s: %s", channel, appErr.Error()))
+			continue
+		}
+
+		// forget users who have left the channel since
+		for userId := range added[mmChannel.Id] {
+			if !memberIds[userId] {
+				record(mmChannel.Id, userId, false)
+			}
+		}
+
+		for _, userId := range userIds {
+			user, found := dir.user(userId)
+			if !found {
+				continue
+			}
+			var matchedRule *channelRule
+			for i := range channelRules {
+				if channelRules[i].matches(user) {
+					matchedRule = &channelRules[i]
+					break
+				}
+			}
+			if matchedRule == nil || memberIds[userId] {
+				continue
+			}
+			change := report.change(userId, channel, "add", matchedRule.String())
+			if report.DryRun {
+				continue
+			}
+			if _, appErr := p.API.AddChannelMember(mmChannel.Id, userId); appErr != nil {
+				change.Error = appErr.Error()
+				continue
+			}
+			record(mmChannel.Id, userId, true)
+		}
+
+		if !removeLeavers {
+			continue
+		}
+		for _, userId := range channelLeavers(dir, channelRules, added[mmChannel.Id], memberIds) {
+			change := report.change(userId, channel, "remove", "")
+			if report.DryRun {
+				continue
+			}
+			if appErr := p.API.DeleteChannelMember(mmChannel.Id, userId); appErr != nil {
+				change.Error = appErr.Error()
+				continue
+			}
+			record(mmChannel.Id, userId, false)
+		}
+	}
+}
+
+// finishChannelRules logs the outcome of applying the channel rules and records any
+// changes actually made in the audit log. The report of a run over all users is kept for
+// admins to see.
+func (p *Plugin) finishChannelRules(report *channelRulesReport, allUsers bool) {
+	audit := []membershipChange{}
+	for _, change := range report.Changes {
+		p.API.LogInfo(fmt.Sprintf("Channel membership: %s %s in %s", change.Action, change.UserId, change.Channel),
+			"rule", change.Rule, "dry_run", change.DryRun, "error", change.Error)
+		if !change.DryRun && change.Error == "" {
+			audit = append(audit, change)
+		}
+	}
+	if len(audit) > 0 {
+		if err := p.appendChannelRulesAudit(audit); err != nil {
+			p.API.LogError("Failed to write channel membership audit log", "error", err)
+		}
+	}
+
+	if !allUsers {
+		return
+	}
+	p.channelRulesReportLock.Lock()
+	defer p.channelRulesReportLock.Unlock()
+	p.channelRulesReport = report
+}
+
+func channelRulesAuditKey(t time.Time) string {
+	return channelRulesAuditKeyPrefix + t.UTC().Format(channelRulesAuditKeyTimeFormat)
+}
+
+// getChannelRulesAudit returns the changes made in the last channelRulesAuditDays days,
+// oldest first.
+func (p *Plugin) getChannelRulesAudit(now time.Time) ([]membershipChange, error) {
+	audit := []membershipChange{}
+	for day := channelRulesAuditDays - 1; day >= 0; day-- {
+		data, appErr := p.API.KVGet(channelRulesAuditKey(now.AddDate(0, 0, -day)))
+		if appErr != nil {
+			return nil, appErr
+		}
+		if data == nil {
+			continue
+		}
+		var changes []membershipChange
+		if err := json.Unmarshal(data, &changes); err != nil {
+			return nil, err
+		}
+		audit = append(audit, changes...)
+	}
+	return audit, nil
+}
+
+// appendChannelRulesAudit adds changes to the audit log of the day they were made, which
+// expires after channelRulesAuditDays days. At most channelRulesAuditMaxDayEntries changes
+// are kept for a day.
+func (p *Plugin) appendChannelRulesAudit(changes []membershipChange) error {
+	keys := []string{}
+	changesByKey := map[string][]membershipChange{}
+	for _, change := range changes {
+		key := channelRulesAuditKey(change.Time)
+		if _, found := changesByKey[key]; !found {
+			keys = append(keys, key)
+		}
+		changesByKey[key] = append(changesByKey[key], change)
+	}
+	for _, key := range keys {
+		err := p.kvUpdate(key, channelRulesAuditDays*24*time.Hour, func(data []byte) ([]byte, error) {
+			audit := []membershipChange{}
+			if data != nil {
+				if err := json.Unmarshal(data, &audit); err != nil {
+					return nil, err
+				}
+			}
+			dayChanges := changesByKey[key]
+			if room := channelRulesAuditMaxDayEntries - len(audit); len(dayChanges) > room {
+				p.API.LogWarn("Channel membership audit log is full for the day", "key", key,
+					"dropped", len(dayChanges)-max(room, 0))
+				dayChanges = dayChanges[:max(room, 0)]
+			}
+			return json.Marshal(append(audit, dayChanges...))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Plugin) handleGetChannelRulesReport(w http.ResponseWriter, r *http.Request) {
+	p.channelRulesReportLock.RLock()
+	report := p.channelRulesReport
+	p.channelRulesReportLock.RUnlock()
+	if report == nil {
+		p.writeApiError(w, http.StatusNotFound, "not found")
+		return
+	}
+	p.writeApiResponse(w, report)
+}
+
+func (p *Plugin) handleGetChannelRulesAudit(w http.ResponseWriter, r *http.Request) {
+	audit, err := p.getChannelRulesAudit(time.Now())
+	if err != nil {
+		p.API.LogError("Failed to read channel membership audit log", "error", err)
+		p.writeApiError(w, http.StatusInternalServerError, "failed to read audit log")
+		return
+	}
+	p.writeApiResponse(w, audit)
+}
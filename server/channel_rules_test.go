@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestParseChannelRules(t *testing.T) {
+	for name, tc := range map[string]struct {
+		text          string
+		expectedRules []channelRule
+		expectedErr   bool
+	}{
+		"empty": {
+			text:          "",
+			expectedRules: []channelRule{},
+		},
+		"blank lines and comments": {
+			text:          "\n  # comment\n\n",
+			expectedRules: []channelRule{},
+		},
+		"rules": {
+			text: "department = Trading -> main/trading-floor\n" +
+				"  Location=Amsterdam->main/~ams-office  \n",
+			expectedRules: []channelRule{
+				{attribute: "department", value: "Trading", teamName: "main", channelName: "trading-floor"},
+				{attribute: "location", value: "Amsterdam", teamName: "main", channelName: "ams-office"},
+			},
+		},
+		"missing target": {
+			text:        "department = Trading",
+			expectedErr: true,
+		},
+		"missing value": {
+			text:        "department -> main/trading-floor",
+			expectedErr: true,
+		},
+		"missing team": {
+			text:        "department = Trading -> trading-floor",
+			expectedErr: true,
+		},
+		"empty value": {
+			text:        "department = -> main/trading-floor",
+			expectedErr: true,
+		},
+		"unknown attribute": {
+			text:        "phone = 1234 -> main/trading-floor",
+			expectedErr: true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			rules, err := parseChannelRules(tc.text)
+			if tc.expectedErr {
+				if err == nil {
+					t.Logf("expected error, got nil")
+					t.Fail()
+				}
+				return
+			}
+			if err != nil {
+				t.Logf("expected no error, got %v", err)
+				t.Fail()
+			}
+			if !reflect.DeepEqual(rules, tc.expectedRules) {
+				t.Logf("expected rules: %v, got %v", tc.expectedRules, rules)
+				t.Fail()
+			}
+		})
+	}
+}
+
+func TestChannelLeavers(t *testing.T) {
+	dir := newDirectory(map[string]User{
+		"alice": {Department: "Trading"},
+		"bob":   {Department: "Sales"},
+		"carol": {Department: "Sales"},
+		"dave":  {Department: "Sales"},
+	})
+	rules := []channelRule{{attribute: "department", value: "trading", teamName: "main", channelName: "trading-floor"}}
+	added := map[string]bool{"alice": true, "bob": true, "dave": true, "erin": true}
+	memberIds := map[string]bool{"alice": true, "bob": true, "carol": true, "erin": true}
+
+	// alice still matches, carol joined without the rules, dave has left the channel and erin has
+	// no Pingboard data, so only bob is removed
+	if leavers, expected := channelLeavers(dir, rules, added, memberIds), []string{"bob"}; !reflect.DeepEqual(leavers, expected) {
+		t.Logf("expected leavers %v, got %v", expected, leavers)
+		t.Fail()
+	}
+}
+
+func TestChannelRulesAddedApply(t *testing.T) {
+	for name, tc := range map[string]struct {
+		keepChannelIds map[string]bool
+		expected       channelRulesAdded
+	}{
+		"some users": {
+			expected: channelRulesAdded{"sales": {"alice": true, "carol": true}, "old": {"dave": true}},
+		},
+		"all users": {
+			keepChannelIds: map[string]bool{"sales": true, "trading": true},
+			expected:       channelRulesAdded{"sales": {"alice": true, "carol": true}},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			// another server added alice to sales meanwhile, and erin has left trading
+			added := channelRulesAdded{
+				"sales":   {"alice": true, "bob": true},
+				"trading": {"erin": true},
+				"old":     {"dave": true},
+			}
+			changes := channelRulesAdded{
+				"sales":   {"bob": false, "carol": true},
+				"trading": {"erin": false},
+			}
+			added.apply(changes, tc.keepChannelIds)
+			if !reflect.DeepEqual(added, tc.expected) {
+				t.Logf("expected %v, got %v", tc.expected, added)
+				t.Fail()
+			}
+		})
+	}
+}
+
+func TestAppendChannelRulesAudit(t *testing.T) {
+	day1 := time.Date(2024, 6, 1, 23, 0, 0, 0, time.UTC)
+	day2 := day1.Add(2 * time.Hour)
+	earlier, _ := json.Marshal([]membershipChange{{Time: day1.Add(-time.Hour), UserId: "alice"}})
+	meanwhile, _ := json.Marshal([]membershipChange{{Time: day1.Add(-time.Hour), UserId: "alice"},
+		{Time: day1.Add(-time.Minute), UserId: "bob"}})
+	expected1, _ := json.Marshal([]membershipChange{{Time: day1.Add(-time.Hour), UserId: "alice"},
+		{Time: day1.Add(-time.Minute), UserId: "bob"}, {Time: day1, UserId: "carol"}})
+	expected2, _ := json.Marshal([]membershipChange{{Time: day2, UserId: "dave"}})
+	expiry := model.PluginKVSetOptions{Atomic: true, ExpireInSeconds: channelRulesAuditDays * 24 * 60 * 60}
+
+	api := &plugintest.API{}
+	// another server writes bob's change first, so carol's is written again on top of it
+	api.On("KVGet", "channel_rules_audit_20240601").Return(earlier, nil).Once()
+	api.On("KVSetWithOptions", "channel_rules_audit_20240601", mock.Anything, mock.Anything).Return(false, nil).Once()
+	api.On("KVGet", "channel_rules_audit_20240601").Return(meanwhile, nil).Once()
+	options := expiry
+	options.OldValue = meanwhile
+	api.On("KVSetWithOptions", "channel_rules_audit_20240601", expected1, options).Return(true, nil).Once()
+	api.On("KVGet", "channel_rules_audit_20240602").Return(nil, nil).Once()
+	api.On("KVSetWithOptions", "channel_rules_audit_20240602", expected2, expiry).Return(true, nil).Once()
+	p := &Plugin{}
+	p.SetAPI(api)
+
+	err := p.appendChannelRulesAudit([]membershipChange{{Time: day1, UserId: "carol"}, {Time: day2, UserId: "dave"}})
+	if err != nil {
+		t.Logf("expected no error, got %v", err)
+		t.Fail()
+	}
+	api.AssertExpectations(t)
+}
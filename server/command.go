@@ -0,0 +1,509 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin"
+)
+
+const commandTrigger = "pingboard"
+
+// The dynamic autocomplete URL of department names, relative to the plugin's HTTP path
+const departmentAutocompletePath = "api/v1/autocomplete/departments"
+
+func (p *Plugin) commandAutocompleteData() *model.AutocompleteData {
+	command := model.NewAutocompleteData(commandTrigger, "[command]", "Look people up in Pingboard")
+
+	whois := model.NewAutocompleteData("whois", "@username", "Show a user's Pingboard details")
+	whois.AddTextArgument("The user to look up", "@username", "")
+	command.AddCommand(whois)
+
+	team := model.NewAutocompleteData("team", "@username [--all]", "List a manager's direct reports, or with --all everyone below them")
+	team.AddTextArgument("The manager", "@username", "")
+	team.AddStaticListArgument("Include everyone below the manager", false,
+		[]model.AutocompleteListItem{{Item: "--all", HelpText: "Everyone below the manager, not only direct reports"}})
+	command.AddCommand(team)
+
+	manager := model.NewAutocompleteData("manager", "@username", "Show a user's management chain")
+	manager.AddTextArgument("The user", "@username", "")
+	command.AddCommand(manager)
+
+	dept := model.NewAutocompleteData("dept", "<department> [--public]", "List the members of a department")
+	dept.AddDynamicListArgument("The department", departmentAutocompletePath, true)
+	dept.AddStaticListArgument("Post the list in the channel", false,
+		[]model.AutocompleteListItem{{Item: "--public", HelpText: "Post the list in the channel rather than only showing it to you"}})
+	command.AddCommand(dept)
+
+	refresh := model.NewAutocompleteData("refresh", "", "Refresh the Pingboard data now (system admins only)")
+	refresh.RoleID = model.SystemAdminRoleId
+	command.AddCommand(refresh)
+
+	status := model.NewAutocompleteData("status", "", "Show the state of the Pingboard data (system admins only)")
+	status.RoleID = model.SystemAdminRoleId
+	command.AddCommand(status)
+
+	return command
+}
+
+func (p *Plugin) registerCommand() error {
+	return p.API.RegisterCommand(&model.Command{
+		Trigger:          commandTrigger,
+		AutoComplete:     true,
+		AutoCompleteDesc: "Look people up in Pingboard",
+		AutoCompleteHint: "[command]",
+		DisplayName:      "Pingboard",
+		AutocompleteData: p.commandAutocompleteData(),
+	})
+}
+
+func ephemeralResponse(text string) *model.CommandResponse {
+	return &model.CommandResponse{
+		ResponseType: model.CommandResponseTypeEphemeral,
+		Text:         text,
+	}
+}
+
+func commandHelp() string {
+	return "Available commands:\n" +
+		"* `/pingboard whois @username` shows a user's Pingboard details\n" +
+		"* `/pingboard team @username [--all]` lists a manager's direct reports, or everyone below them\n" +
+		"* `/pingboard manager @username` shows a user's management chain\n" +
+		"* `/pingboard dept <department> [--public]` lists the members of a department, optionally posting the list in the channel\n" +
+		"* `/pingboard refresh` refreshes the Pingboard data now (system admins only)\n" +
+		"* `/pingboard status` shows the last refresh, what it loaded, the next one and recent errors (system admins only)"
+}
+
+func (p *Plugin) ExecuteCommand(_ *plugin.Context, args *model.CommandArgs) (*model.CommandResponse, *model.AppError) {
+	fields := strings.Fields(args.Command)
+	if len(fields) < 2 {
+		return ephemeralResponse(commandHelp()), nil
+	}
+	switch fields[1] {
+	case "whois":
+		return ephemeralResponse(p.executeWhois(args, fields[2:])), nil
+	case "team":
+		return ephemeralResponse(p.executeTeam(args, fields[2:])), nil
+	case "manager":
+		return ephemeralResponse(p.executeManager(args, fields[2:])), nil
+	case "dept":
+		return p.executeDept(args, fields[2:]), nil
+	case "refresh":
+		return ephemeralResponse(p.executeRefresh(args)), nil
+	case "status":
+		return ephemeralResponse(p.executeStatus(args)), nil
+	default:
+		return ephemeralResponse(commandHelp()), nil
+	}
+}
+
+// commandUserId resolves a username given to a command, with or without the @, to a
+// mattermost user ID. If that fails, returns a message saying why instead.
+func (p *Plugin) commandUserId(arg string) (string, string) {
+	username := strings.ToLower(strings.TrimPrefix(arg, "@"))
+	mmUser, appErr := p.API.GetUserByUsername(username)
+	if appErr != nil {
+		return "", fmt.Sprintf("Could not find user @%s.", username)
+	}
+	return mmUser.Id, ""
+}
+
+// commandDirectoryUser looks up the user given to a command in the directory, with the
+// fields the viewer can see. If that fails, returns a message saying why instead.
+func (p *Plugin) commandDirectoryUser(v *viewer, arg string) (*directory, string, User, string) {
+	userId, message := p.commandUserId(arg)
+	if message != "" {
+		return nil, "", User{}, message
+	}
+	dir := p.getDirectory()
+	if dir == nil {
+		return nil, "", User{}, "No Pingboard data has been loaded yet."
+	}
+	user, found := dir.user(userId)
+	if found {
+		user, found = v.filterUser(dir, userId, user)
+	}
+	if !found {
+		return nil, "", User{}, fmt.Sprintf("No Pingboard data found for %s.", arg)
+	}
+	return dir, userId, user, ""
+}
+
+// describeTenure describes how long ago the start date was, in years and months, as the
+// popover does.
+func describeTenure(start time.Time, now time.Time) string {
+	if start.After(now) {
+		return ""
+	}
+	years := now.Year() - start.Year()
+	months := int(now.Month()) - int(start.Month())
+	if now.Day() < start.Day() {
+		months--
+	}
+	if months < 0 {
+		years--
+		months += 12
+	}
+	if years == 0 && months == 0 {
+		return "New starter"
+	}
+
+	parts := []string{}
+	plural := func(n int, unit string) string {
+		if n == 1 {
+			return fmt.Sprintf("%d %s", n, unit)
+		}
+		return fmt.Sprintf("%d %ss", n, unit)
+	}
+	if years > 0 {
+		parts = append(parts, plural(years, "year"))
+	}
+	if months > 0 {
+		parts = append(parts, plural(months, "month"))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// whoisCard renders the user's details, leaving out those that are not known or not
+// visible.
+func whoisCard(user User, username string, managerUsername string, now time.Time) string {
+	name := strings.TrimSpace(user.FirstName + " " + user.LastName)
+	if user.Nickname != "" && user.Nickname != user.FirstName {
+		name += fmt.Sprintf(" (%s)", user.Nickname)
+	}
+	lines := []string{}
+	if name != "" {
+		lines = append(lines, fmt.Sprintf("#### %s @%s", name, username))
+	} else {
+		lines = append(lines, fmt.Sprintf("#### @%s", username))
+	}
+	if user.JobTitle != "" || user.Department != "" {
+		description := user.JobTitle
+		if user.Department != "" {
+			description = strings.TrimSpace(fmt.Sprintf("%s (%s)", description, user.Department))
+		}
+		lines = append(lines, "👤 "+description)
+	}
+	if managerUsername != "" {
+		lines = append(lines, "⬆️ @"+managerUsername)
+	}
+	if user.StartYear > 0 {
+		start := time.Date(user.StartYear, time.Month(user.StartMonth), user.StartDay, 0, 0, 0, 0, now.Location())
+		if tenure := describeTenure(start, now); tenure != "" {
+			lines = append(lines, fmt.Sprintf("🗓 %s (since %s)", tenure, start.Format("2 Jan 2006")))
+		}
+	}
+	if user.Phone != "" {
+		lines = append(lines, "📞 "+user.Phone)
+	}
+	if user.Location != "" {
+		lines = append(lines, "📍 "+user.Location)
+	}
+	if user.Url != "" {
+		lines = append(lines, fmt.Sprintf("↪ [Pingboard profile](%s)", user.Url))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (p *Plugin) executeWhois(args *model.CommandArgs, params []string) string {
+	if len(params) != 1 {
+		return "Usage: `/pingboard whois @username`"
+	}
+	_, userId, user, message := p.commandDirectoryUser(p.newUserViewer(args.UserId), params[0])
+	if message != "" {
+		return message
+	}
+
+	usernames := p.newUsernameCache()
+	user = presentUser(user, usernames)
+	p.recordLookups(args.UserId, "/pingboard whois", map[string]User{userId: user})
+	return whoisCard(user, usernames.username(userId), user.Manager, time.Now())
+}
+
+// Most rows shown in a table, to keep within the size of a message
+const commandMaxTableRows = 100
+
+var markdownTableEscaper = strings.NewReplacer("|", `\|`, "\n", " ")
+
+// userTable renders the users as a markdown table of their username, name, job title and
+// department, as far as the viewer can see them, optionally with their manager.
+func (p *Plugin) userTable(dir *directory, v *viewer, userIds []string, withManager bool) string {
+	header := "| User | Name | Job title | Department |"
+	divider := "|:--|:--|:--|:--|"
+	if withManager {
+		header += " Manager |"
+		divider += ":--|"
+	}
+	lines := []string{header, divider}
+
+	usernames := p.newUsernameCache()
+	for i, userId := range userIds {
+		if i == commandMaxTableRows {
+			lines = append(lines, fmt.Sprintf("\n…and %d more.", len(userIds)-commandMaxTableRows))
+			break
+		}
+		user, _ := dir.user(userId)
+		user, _ = v.filterUser(dir, userId, user)
+		cells := []string{
+			"@" + usernames.username(userId),
+			strings.TrimSpace(user.FirstName + " " + user.LastName),
+			user.JobTitle,
+			user.Department,
+		}
+		if withManager {
+			manager := ""
+			if user.ManagerId != "" {
+				manager = "@" + usernames.username(user.ManagerId)
+			}
+			cells = append(cells, manager)
+		}
+		for j := range cells {
+			cells[j] = markdownTableEscaper.Replace(cells[j])
+		}
+		lines = append(lines, "| "+strings.Join(cells, " | ")+" |")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// parseTeamParams returns the manager given to the team command, and whether the --all
+// flag was given. Returns false if the parameters are not valid.
+func parseTeamParams(params []string) (string, bool, bool) {
+	all := false
+	managerArg := ""
+	for _, param := range params {
+		switch {
+		case param == "--all":
+			all = true
+		case managerArg == "" && !strings.HasPrefix(param, "--"):
+			managerArg = param
+		default:
+			return "", false, false
+		}
+	}
+	return managerArg, all, managerArg != ""
+}
+
+func (p *Plugin) executeTeam(args *model.CommandArgs, params []string) string {
+	managerArg, all, ok := parseTeamParams(params)
+	if !ok {
+		return "Usage: `/pingboard team @username [--all]`"
+	}
+
+	v := p.newUserViewer(args.UserId)
+	dir, managerId, _, message := p.commandDirectoryUser(v, managerArg)
+	if message != "" {
+		return message
+	}
+	direct, indirect := v.visibleReports(dir, managerId)
+	username := p.newUsernameCache().username(managerId)
+
+	if !all {
+		if len(direct) == 0 {
+			return fmt.Sprintf("@%s has no direct reports.", username)
+		}
+		return fmt.Sprintf("#### Direct reports of @%s (%d)\n", username, len(direct)) +
+			p.userTable(dir, v, direct, false)
+	}
+	everyone := append(append([]string{}, direct...), indirect...)
+	if len(everyone) == 0 {
+		return fmt.Sprintf("@%s has nobody reporting to them.", username)
+	}
+	return fmt.Sprintf("#### Everyone below @%s (%d, of whom %d direct reports)\n", username, len(everyone), len(direct)) +
+		p.userTable(dir, v, everyone, true)
+}
+
+func (p *Plugin) executeManager(args *model.CommandArgs, params []string) string {
+	if len(params) != 1 {
+		return "Usage: `/pingboard manager @username`"
+	}
+	v := p.newUserViewer(args.UserId)
+	dir, userId, _, message := p.commandDirectoryUser(v, params[0])
+	if message != "" {
+		return message
+	}
+	chain, cycle := dir.managementChain(userId)
+	if visible := v.visibleChain(dir, userId, chain); len(visible) < len(chain) {
+		chain = visible
+		cycle = false
+	}
+	username := p.newUsernameCache().username(userId)
+	if len(chain) == 0 {
+		return fmt.Sprintf("No manager found for @%s.", username)
+	}
+
+	text := fmt.Sprintf("#### Management chain of @%s, immediate manager first\n", username) +
+		p.userTable(dir, v, chain, false)
+	if cycle {
+		text += "\n\nThe reporting lines loop back on themselves here."
+	}
+	return text
+}
+
+// parseDeptParams returns the department name, which may contain spaces, and whether the
+// --public flag was given.
+func parseDeptParams(params []string) (string, bool) {
+	public := false
+	words := []string{}
+	for _, param := range params {
+		if param == "--public" {
+			public = true
+		} else {
+			words = append(words, param)
+		}
+	}
+	return strings.Join(words, " "), public
+}
+
+func (p *Plugin) executeDept(args *model.CommandArgs, params []string) *model.CommandResponse {
+	name, public := parseDeptParams(params)
+	if name == "" {
+		return ephemeralResponse("Usage: `/pingboard dept <department> [--public]`")
+	}
+	dir := p.getDirectory()
+	if dir == nil {
+		return ephemeralResponse("No Pingboard data has been loaded yet.")
+	}
+
+	dept, found := dir.departments[strings.ToLower(name)]
+	v := p.newUserViewer(args.UserId)
+	memberIds := []string{}
+	if found {
+		memberIds = v.filterUserIds(dir, dept.memberIds, visibleFieldDepartment)
+	}
+	if len(memberIds) == 0 {
+		return ephemeralResponse(fmt.Sprintf("No department named %s found.", name))
+	}
+	if public {
+		// a list posted in the channel only shows what everyone in the channel can see
+		v = p.newChannelViewer(args.ChannelId, v.isGuest)
+		if memberIds = v.filterUserIds(dir, memberIds, visibleFieldDepartment); len(memberIds) == 0 {
+			return ephemeralResponse(fmt.Sprintf("The members of %s cannot be shown to everyone in this channel.", dept.name))
+		}
+	}
+
+	text := fmt.Sprintf("#### Members of %s (%d)\n", dept.name, len(memberIds))
+	if head := v.departmentHead(dir, dept, p.newUsernameCache()); head != nil {
+		text = fmt.Sprintf("#### Members of %s (%d), headed by @%s\n", dept.name, len(memberIds), head.Username)
+	}
+	text += p.userTable(dir, v, memberIds, false)
+	if !public {
+		return ephemeralResponse(text)
+	}
+	return &model.CommandResponse{
+		ResponseType: model.CommandResponseTypeInChannel,
+		Text:         text,
+	}
+}
+
+// handleGetDepartmentAutocomplete returns the departments the user can see, as
+// suggestions for the department argument of the dept command.
+func (p *Plugin) handleGetDepartmentAutocomplete(w http.ResponseWriter, r *http.Request) {
+	items := []model.AutocompleteListItem{}
+	dir := p.getDirectory()
+	if dir == nil {
+		p.writeApiResponse(w, items)
+		return
+	}
+	v := p.newViewer(r)
+	for _, dept := range dir.sortedDepartments() {
+		headcount := len(v.filterUserIds(dir, dept.memberIds, visibleFieldDepartment))
+		if headcount == 0 {
+			continue
+		}
+		helpText := fmt.Sprintf("%d members", headcount)
+		if headcount == 1 {
+			helpText = "1 member"
+		}
+		items = append(items, model.AutocompleteListItem{Item: dept.name, HelpText: helpText})
+	}
+	p.API.LogDebug(fmt.Sprintf("Returning %d departments for autocomplete", len(items)))
+	p.writeApiResponse(w, items)
+}
+
+// describeTime gives the time in UTC, with how long ago or from now it is.
+func describeTime(t time.Time, now time.Time) string {
+	formatted := t.UTC().Format("2006-01-02 15:04:05 MST")
+	if t.After(now) {
+		return fmt.Sprintf("%s (in %s)", formatted, t.Sub(now).Round(time.Second))
+	}
+	return fmt.Sprintf("%s (%s ago)", formatted, now.Sub(t).Round(time.Second))
+}
+
+func describeRefreshSummary(summary *refreshSummary) string {
+	return fmt.Sprintf("%d of %d Pingboard users matched to %d Mattermost users, in %d departments",
+		summary.MatchedUsers, summary.PingboardUsers, summary.MattermostUsers, summary.Departments)
+}
+
+func (p *Plugin) executeRefresh(args *model.CommandArgs) string {
+	if !p.API.HasPermissionTo(args.UserId, model.PermissionManageSystem) {
+		return "Only system admins can refresh the Pingboard data."
+	}
+	if !p.commandRefreshing.CompareAndSwap(false, true) {
+		return "A refresh requested with this command is already running. See `/pingboard status` for how it went once it is done."
+	}
+
+	notify := func(message string) {
+		p.API.SendEphemeralPost(args.UserId, &model.Post{
+			UserId:    args.UserId,
+			ChannelId: args.ChannelId,
+			RootId:    args.RootId,
+			Message:   message,
+		})
+	}
+	p.API.LogInfo("Refresh requested by command", "user_id", args.UserId)
+	go func() {
+		defer p.commandRefreshing.Store(false)
+		// a refresh already running for another reason finishes first
+		summary, err := p.refresh(notify)
+		if err != nil {
+			notify("Refreshing the Pingboard data failed: " + err.Error())
+			return
+		}
+		notify(fmt.Sprintf("Refreshed the Pingboard data in %s: %s.",
+			p.getRefreshStatus().LastDuration, describeRefreshSummary(summary)))
+	}()
+	return "Refreshing the Pingboard data. Progress will be shown here."
+}
+
+// statusText describes the refreshes and the data they loaded, as of now.
+func statusText(status refreshStatus, nextRefreshAt time.Time, now time.Time) string {
+	lines := []string{"#### Pingboard status"}
+	if status.NotConfigured {
+		lines = append(lines, "* Not configured: set the Pingboard API client ID and secret to load data")
+	}
+	if status.Running {
+		lines = append(lines, "* Refresh running since "+describeTime(status.LastStartedAt, now))
+	}
+	if status.LastSummary != nil {
+		lines = append(lines,
+			fmt.Sprintf("* Last successful refresh: %s, taking %s", describeTime(status.LastSucceededAt, now), status.LastDuration),
+			"* Loaded: "+describeRefreshSummary(status.LastSummary))
+	} else {
+		lines = append(lines, "* Last successful refresh: none since the plugin started")
+	}
+	if nextRefreshAt.IsZero() {
+		lines = append(lines, "* Next refresh: not scheduled")
+	} else {
+		lines = append(lines, "* Next refresh: "+describeTime(nextRefreshAt, now))
+	}
+	if len(status.RecentErrors) == 0 {
+		lines = append(lines, "* Recent errors: none")
+	} else {
+		lines = append(lines, "* Recent errors, most recent first:")
+		for i := len(status.RecentErrors) - 1; i >= 0; i-- {
+			refreshErr := status.RecentErrors[i]
+			lines = append(lines, fmt.Sprintf("  * %s: %s", describeTime(refreshErr.Time, now), refreshErr.Message))
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (p *Plugin) executeStatus(args *model.CommandArgs) string {
+	if !p.API.HasPermissionTo(args.UserId, model.PermissionManageSystem) {
+		return "Only system admins can see the status of the Pingboard data."
+	}
+	return statusText(p.getRefreshStatus(), p.nextRefreshAt(), time.Now())
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+func TestDescribeTenure(t *testing.T) {
+	// the same cases as the popover's, with months from 1 rather than 0
+	start := time.Date(2010, 7, 10, 0, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		now      time.Time
+		expected string
+	}{
+		{now: time.Date(2010, 2, 30, 0, 0, 0, 0, time.UTC), expected: ""},
+		{now: time.Date(2010, 7, 10, 0, 0, 0, 0, time.UTC), expected: "New starter"},
+		{now: time.Date(2010, 7, 30, 0, 0, 0, 0, time.UTC), expected: "New starter"},
+		{now: time.Date(2010, 8, 9, 0, 0, 0, 0, time.UTC), expected: "New starter"},
+		{now: time.Date(2010, 8, 10, 0, 0, 0, 0, time.UTC), expected: "1 month"},
+		{now: time.Date(2010, 9, 9, 0, 0, 0, 0, time.UTC), expected: "1 month"},
+		{now: time.Date(2010, 9, 10, 0, 0, 0, 0, time.UTC), expected: "2 months"},
+		{now: time.Date(2011, 7, 9, 0, 0, 0, 0, time.UTC), expected: "11 months"},
+		{now: time.Date(2011, 7, 10, 0, 0, 0, 0, time.UTC), expected: "1 year"},
+		{now: time.Date(2011, 9, 30, 0, 0, 0, 0, time.UTC), expected: "1 year, 2 months"},
+		{now: time.Date(2011, 11, 11, 0, 0, 0, 0, time.UTC), expected: "1 year, 4 months"},
+		{now: time.Date(2013, 7, 10, 0, 0, 0, 0, time.UTC), expected: "3 years"},
+	} {
+		if tenure := describeTenure(start, tc.now); tenure != tc.expected {
+			t.Logf("%s: expected %q, got %q", tc.now.Format("2006-01-02"), tc.expected, tenure)
+			t.Fail()
+		}
+	}
+}
+
+func TestWhoisCard(t *testing.T) {
+	now := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	for name, tc := range map[string]struct {
+		user     User
+		manager  string
+		expected string
+	}{
+		"everything": {
+			user: User{FirstName: "Alice", LastName: "Smith", Nickname: "Al", JobTitle: "Trader", Department: "Trading",
+				StartYear: 2020, StartMonth: 3, StartDay: 2, Phone: "123", Location: "Amsterdam", Url: "https://x/1"},
+			manager: "bob",
+			expected: "#### Alice Smith (Al) @alice\n" +
+				"👤 Trader (Trading)\n" +
+				"⬆️ @bob\n" +
+				"🗓 4 years, 2 months (since 2 Mar 2020)\n" +
+				"📞 123\n" +
+				"📍 Amsterdam\n" +
+				"↪ [Pingboard profile](https://x/1)",
+		},
+		"nothing visible but the department": {
+			user:     User{Department: "Trading"},
+			expected: "#### @alice\n👤 (Trading)",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if card := whoisCard(tc.user, "alice", tc.manager, now); card != tc.expected {
+				t.Logf("expected:\n%s\ngot:\n%s", tc.expected, card)
+				t.Fail()
+			}
+		})
+	}
+}
+
+func TestParseDeptParams(t *testing.T) {
+	for _, tc := range []struct {
+		params []string
+		name   string
+		public bool
+	}{
+		{params: []string{}, name: "", public: false},
+		{params: []string{"Trading"}, name: "Trading", public: false},
+		{params: []string{"Human", "Resources", "--public"}, name: "Human Resources", public: true},
+		{params: []string{"--public", "Trading"}, name: "Trading", public: true},
+	} {
+		if name, public := parseDeptParams(tc.params); name != tc.name || public != tc.public {
+			t.Logf("%v: expected %q, %v, got %q, %v", tc.params, tc.name, tc.public, name, public)
+			t.Fail()
+		}
+	}
+}
+
+func TestStatusText(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	for name, tc := range map[string]struct {
+		status        refreshStatus
+		nextRefreshAt time.Time
+		expected      string
+	}{
+		"never refreshed": {
+			expected: "#### Pingboard status\n" +
+				"* Last successful refresh: none since the plugin started\n" +
+				"* Next refresh: not scheduled\n" +
+				"* Recent errors: none",
+		},
+		"not configured": {
+			status: refreshStatus{NotConfigured: true},
+			expected: "#### Pingboard status\n" +
+				"* Not configured: set the Pingboard API client ID and secret to load data\n" +
+				"* Last successful refresh: none since the plugin started\n" +
+				"* Next refresh: not scheduled\n" +
+				"* Recent errors: none",
+		},
+		"refreshed, then failed": {
+			status: refreshStatus{
+				LastSucceededAt: now.Add(-2 * time.Hour),
+				LastDuration:    "1.5s",
+				LastSummary:     &refreshSummary{MattermostUsers: 10, PingboardUsers: 9, MatchedUsers: 8, Departments: 2},
+				RecentErrors: []refreshError{
+					{Time: now.Add(-time.Hour), Message: "first"},
+					{Time: now.Add(-time.Minute), Message: "second"},
+				},
+			},
+			nextRefreshAt: now.Add(4 * time.Hour),
+			expected: "#### Pingboard status\n" +
+				"* Last successful refresh: 2024-06-01 10:00:00 UTC (2h0m0s ago), taking 1.5s\n" +
+				"* Loaded: 8 of 9 Pingboard users matched to 10 Mattermost users, in 2 departments\n" +
+				"* Next refresh: 2024-06-01 16:00:00 UTC (in 4h0m0s)\n" +
+				"* Recent errors, most recent first:\n" +
+				"  * 2024-06-01 11:59:00 UTC (1m0s ago): second\n" +
+				"  * 2024-06-01 11:00:00 UTC (1h0m0s ago): first",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if text := statusText(tc.status, tc.nextRefreshAt, now); text != tc.expected {
+				t.Logf("Expected %q, got %q", tc.expected, text)
+				t.Fail()
+			}
+		})
+	}
+}
+
+func TestParseTeamParams(t *testing.T) {
+	for _, tc := range []struct {
+		params  []string
+		manager string
+		all     bool
+		ok      bool
+	}{
+		{params: []string{}, ok: false},
+		{params: []string{"@bob"}, manager: "@bob", all: false, ok: true},
+		{params: []string{"@bob", "--all"}, manager: "@bob", all: true, ok: true},
+		{params: []string{"--all", "bob"}, manager: "bob", all: true, ok: true},
+		{params: []string{"--all"}, ok: false},
+		{params: []string{"@bob", "@carol"}, ok: false},
+		{params: []string{"@bob", "--deep"}, ok: false},
+	} {
+		manager, all, ok := parseTeamParams(tc.params)
+		if ok != tc.ok || (ok && (manager != tc.manager || all != tc.all)) {
+			t.Logf("%v: expected %q, %v, %v, got %q, %v, %v", tc.params, tc.manager, tc.all, tc.ok, manager, all, ok)
+			t.Fail()
+		}
+	}
+}
+
+// usernameTestAPI gives every mattermost user a username the same as their ID.
+type usernameTestAPI struct {
+	logOnlyAPI
+}
+
+func (usernameTestAPI) GetUser(userId string) (*model.User, *model.AppError) {
+	return &model.User{Id: userId, Username: userId}, nil
+}
+
+func TestUserTable(t *testing.T) {
+	p := &Plugin{}
+	p.SetAPI(usernameTestAPI{})
+	v := &viewer{plugin: p, config: &configuration{}, isAdmin: true}
+
+	t.Run("escaped cells", func(t *testing.T) {
+		dir := newDirectory(map[string]User{
+			"alice": {FirstName: "Alice", LastName: "Smith", JobTitle: "R|D lead", Department: "Risk\nand compliance"},
+			"bob":   {FirstName: "Bob", ManagerId: "alice"},
+		})
+		expected := "| User | Name | Job title | Department | Manager |\n" +
+			"|:--|:--|:--|:--|:--|\n" +
+			"| @alice | Alice Smith | R\\|D lead | Risk and compliance |  |\n" +
+			"| @bob | Bob |  |  | @alice |"
+		if table := p.userTable(dir, v, []string{"alice", "bob"}, true); table != expected {
+			t.Logf("expected %q, got %q", expected, table)
+			t.Fail()
+		}
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		usersById := map[string]User{}
+		userIds := []string{}
+		for i := 0; i < commandMaxTableRows+5; i++ {
+			userId := fmt.Sprintf("user%03d", i)
+			usersById[userId] = User{}
+			userIds = append(userIds, userId)
+		}
+		lines := strings.Split(p.userTable(newDirectory(usersById), v, userIds, false), "\n")
+		if len(lines) != 2+commandMaxTableRows+2 || lines[len(lines)-1] != "…and 5 more." ||
+			lines[len(lines)-3] != fmt.Sprintf("| @user%03d |  |  |  |", commandMaxTableRows-1) {
+			t.Logf("expected %d rows and a note of 5 more, got %d lines ending %q", commandMaxTableRows, len(lines), lines[len(lines)-3:])
+			t.Fail()
+		}
+	})
+}
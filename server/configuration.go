@@ -5,8 +5,46 @@ import (
 )
 
 type configuration struct {
-	PingboardApiId     string `json:"pingboardApiClientID"`
-	PingboardApiSecret string `json:"pingboardApiClientSecret"`
+	PingboardApiId      string `json:"pingboardApiClientID"`
+	PingboardApiSecret  string `json:"pingboardApiClientSecret"`
+	ProfileSyncEnabled  bool   `json:"profileSyncEnabled"`
+	ProfileSyncDryRun   bool   `json:"profileSyncDryRun"`
+	ProfileSyncPosition bool   `json:"profileSyncPosition"`
+	ProfileSyncNames    bool   `json:"profileSyncNames"`
+	ProfileSyncNickname bool   `json:"profileSyncNickname"`
+	ChannelRules        string `json:"channelRules"`
+	ChannelRulesMode    string `json:"channelRulesMode"`
+	ChannelRulesDryRun  bool   `json:"channelRulesDryRun"`
+
+	OffboardingPolicy          string `json:"offboardingPolicy"`
+	OffboardingMissedRefreshes int    `json:"offboardingMissedRefreshes"`
+	OffboardingGraceDays       int    `json:"offboardingGraceDays"`
+	OffboardingExcludedUsers   string `json:"offboardingExcludedUsers"`
+	OffboardingDryRun          bool   `json:"offboardingDryRun"`
+
+	CustomStatusEnabled bool   `json:"customStatusEnabled"`
+	CustomStatusTypes   string `json:"customStatusTypes"`
+
+	VisibilityName       string `json:"visibilityName"`
+	VisibilityJobTitle   string `json:"visibilityJobTitle"`
+	VisibilityDepartment string `json:"visibilityDepartment"`
+	VisibilityLocation   string `json:"visibilityLocation"`
+	VisibilityManager    string `json:"visibilityManager"`
+	VisibilityStartDate  string `json:"visibilityStartDate"`
+	VisibilityPhone      string `json:"visibilityPhone"`
+	VisibilityEmail      string `json:"visibilityEmail"`
+
+	WebhookSecret         string `json:"webhookSecret"` // for webhook routes; not in the settings while there are none
+	InterPluginAllowedIds string `json:"interPluginAllowedIds"`
+
+	LookupAuditEnabled       bool   `json:"lookupAuditEnabled"`
+	LookupAuditFields        string `json:"lookupAuditFields"`
+	LookupAuditRetentionDays int    `json:"lookupAuditRetentionDays"`
+
+	RateLimitEnabled   bool   `json:"rateLimitEnabled"`
+	RateLimitPerMinute int    `json:"rateLimitPerMinute"`
+	RateLimitBurst     int    `json:"rateLimitBurst"`
+	RateLimitOverrides string `json:"rateLimitOverrides"`
 }
 
 func (c *configuration) Clone() *configuration {
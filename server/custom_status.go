@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+
+	"github.com/imc/mattermost-plugin-pingboard/server/pingboard"
+)
+
+// The custom status last set by the plugin is kept per user, so that statuses the user
+// set themselves can be told apart and left alone.
+const customStatusKeyPrefix = "custom_status_"
+
+const customStatusEmoji = "palm_tree"
+
+// timeOffStatus returns the custom status for a user with the given current Pingboard
+// statuses, or nil if none of them is time off.
+func timeOffStatus(statuses []pingboard.Status, timeOffTypes map[string]bool) *model.CustomStatus {
+	var until time.Time
+	for _, status := range statuses {
+		if timeOffTypes[strings.ToLower(status.TypeName)] && status.EndsAt.After(until) {
+			until = status.EndsAt
+		}
+	}
+	if until.IsZero() {
+		return nil
+	}
+	// time off ends at the start of the day the user is back, so name the day before
+	lastDay := until.Add(-time.Nanosecond)
+	return &model.CustomStatus{
+		Emoji:     customStatusEmoji,
+		Text:      "Out of office until " + lastDay.Format("2 Jan"),
+		Duration:  "date_and_time",
+		ExpiresAt: until,
+	}
+}
+
+func isCustomStatusSet(status *model.CustomStatus, now time.Time) bool {
+	return status != nil && (status.Text != "" || status.Emoji != "") &&
+		(status.ExpiresAt.IsZero() || status.ExpiresAt.After(now))
+}
+
+func (p *Plugin) getPluginCustomStatus(userId string) (*model.CustomStatus, error) {
+	data, appErr := p.API.KVGet(customStatusKeyPrefix + userId)
+	if appErr != nil {
+		return nil, appErr
+	}
+	if data == nil {
+		return nil, nil
+	}
+	var status *model.CustomStatus
+	if err := json.Unmarshal(data, &status); err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+// syncCustomStatus sets the user's custom status to want, or removes the status the plugin
+// set before if want is nil. A custom status that the plugin did not set is never changed.
+// Returns what was done, if anything.
+func (p *Plugin) syncCustomStatus(userId string, want *model.CustomStatus) (string, error) {
+	ours, err := p.getPluginCustomStatus(userId)
+	if err != nil {
+		return "", err
+	}
+	if want == nil && ours == nil {
+		return "", nil
+	}
+
+	mmUser, appErr := p.API.GetUser(userId)
+	if appErr != nil {
+		return "", appErr
+	}
+	now := time.Now()
+	current := mmUser.GetCustomStatus()
+	currentIsOurs := ours != nil && current != nil && current.Emoji == ours.Emoji && current.Text == ours.Text
+	if isCustomStatusSet(current, now) && !currentIsOurs {
+		// the user has set their own status, which also replaced any of ours
+		if ours != nil {
+			if appErr := p.API.KVDelete(customStatusKeyPrefix + userId); appErr != nil {
+				return "", appErr
+			}
+		}
+		return "", nil
+	}
+
+	if want == nil {
+		if currentIsOurs {
+			if appErr := p.API.RemoveUserCustomStatus(userId); appErr != nil {
+				return "", appErr
+			}
+		}
+		if appErr := p.API.KVDelete(customStatusKeyPrefix + userId); appErr != nil {
+			return "", appErr
+		}
+		return "cleared", nil
+	}
+
+	if currentIsOurs && isCustomStatusSet(current, now) && current.Text == want.Text {
+		return "", nil
+	}
+	if appErr := p.API.UpdateUserCustomStatus(userId, want); appErr != nil {
+		return "", appErr
+	}
+	data, err := json.Marshal(want)
+	if err != nil {
+		return "", err
+	}
+	if appErr := p.API.KVSet(customStatusKeyPrefix+userId, data); appErr != nil {
+		return "", appErr
+	}
+	return "set", nil
+}
+
+// syncCustomStatuses gives users on time off in Pingboard a custom status saying so, if
+// enabled in the configuration.
+func (p *Plugin) syncCustomStatuses(dir *directory) {
+	config := p.getConfiguration()
+	if !config.CustomStatusEnabled || dir.pingboardData.statusesByUserId == nil {
+		return
+	}
+
+	timeOffTypes := map[string]bool{}
+	for _, typeName := range strings.Split(config.CustomStatusTypes, ",") {
+		if typeName = strings.ToLower(strings.TrimSpace(typeName)); typeName != "" {
+			timeOffTypes[typeName] = true
+		}
+	}
+
+	locks, _, err := p.getProfileLocks()
+	if err != nil {
+		p.API.LogError("Failed to get profile locks", "error", err)
+		return
+	}
+	set := 0
+	cleared := 0
+	for userId, user := range dir.usersById {
+		want := timeOffStatus(dir.pingboardData.statusesByUserId[user.Id], timeOffTypes)
+		if locks.locked(userId, profileFieldCustomStatus) {
+			want = nil
+		}
+		action, err := p.syncCustomStatus(userId, want)
+		if err != nil {
+			p.API.LogError("Failed to sync custom status", "user_id", userId, "error", err)
+			continue
+		}
+		switch action {
+		case "set":
+			set++
+		case "cleared":
+			cleared++
+		}
+	}
+	p.API.LogInfo(fmt.Sprintf("Custom statuses: %d set, %d cleared", set, cleared))
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/imc/mattermost-plugin-pingboard/server/pingboard"
+)
+
+func TestTimeOffStatus(t *testing.T) {
+	amsterdam := time.FixedZone("CEST", 2*60*60)
+	monday := time.Date(2024, 6, 3, 0, 0, 0, 0, amsterdam)
+	timeOffTypes := map[string]bool{"vacation": true, "sick": true}
+	for name, tc := range map[string]struct {
+		statuses     []pingboard.Status
+		expectedText string // empty for no status
+	}{
+		"no statuses": {},
+		"not time off": {
+			statuses: []pingboard.Status{{TypeName: "Remote", EndsAt: monday}},
+		},
+		"back on monday": {
+			statuses:     []pingboard.Status{{TypeName: "Vacation", EndsAt: monday}},
+			expectedText: "Out of office until 2 Jun",
+		},
+		"back during the day": {
+			statuses:     []pingboard.Status{{TypeName: "sick", EndsAt: monday.Add(13 * time.Hour)}},
+			expectedText: "Out of office until 3 Jun",
+		},
+		"latest end": {
+			statuses: []pingboard.Status{
+				{TypeName: "Vacation", EndsAt: monday.AddDate(0, 0, 7)},
+				{TypeName: "Remote", EndsAt: monday.AddDate(0, 0, 14)},
+				{TypeName: "Sick", EndsAt: monday},
+			},
+			expectedText: "Out of office until 9 Jun",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			status := timeOffStatus(tc.statuses, timeOffTypes)
+			text := ""
+			if status != nil {
+				text = status.Text
+			}
+			if text != tc.expectedText {
+				t.Logf("expected %q, got %q", tc.expectedText, text)
+				t.Fail()
+			}
+		})
+	}
+}
+
+func TestSyncCustomStatus(t *testing.T) {
+	now := time.Now()
+	ours := &model.CustomStatus{Emoji: customStatusEmoji, Text: "Out of office until 2 Jun", ExpiresAt: now.Add(time.Hour)}
+	theirs := &model.CustomStatus{Emoji: "house", Text: "Working from home"}
+	want := &model.CustomStatus{Emoji: customStatusEmoji, Text: "Out of office until 9 Jun", ExpiresAt: now.Add(24 * time.Hour)}
+	for name, tc := range map[string]struct {
+		ours           *model.CustomStatus // as recorded by the plugin
+		current        *model.CustomStatus
+		want           *model.CustomStatus
+		expectedAction string
+		expectedCalls  []string // that change anything
+	}{
+		"set": {
+			want:           want,
+			expectedAction: "set",
+			expectedCalls:  []string{"UpdateUserCustomStatus", "KVSet"},
+		},
+		"replace ours": {
+			ours:           ours,
+			current:        ours,
+			want:           want,
+			expectedAction: "set",
+			expectedCalls:  []string{"UpdateUserCustomStatus", "KVSet"},
+		},
+		"clear ours": {
+			ours:           ours,
+			current:        ours,
+			expectedAction: "cleared",
+			expectedCalls:  []string{"RemoveUserCustomStatus", "KVDelete"},
+		},
+		"their own": {
+			current: theirs,
+			want:    want,
+		},
+		"their own replaced ours": {
+			ours:          ours,
+			current:       theirs,
+			want:          want,
+			expectedCalls: []string{"KVDelete"},
+		},
+		"nothing to do": {
+			current: theirs,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			api := &plugintest.API{}
+			var oursData []byte
+			if tc.ours != nil {
+				oursData, _ = json.Marshal(tc.ours)
+			}
+			api.On("KVGet", customStatusKeyPrefix+"alice").Return(oursData, nil)
+			mmUser := &model.User{Id: "alice"}
+			if tc.current != nil {
+				_ = mmUser.SetCustomStatus(tc.current)
+			}
+			api.On("GetUser", "alice").Return(mmUser, nil).Maybe()
+			api.On("UpdateUserCustomStatus", "alice", tc.want).Return(nil).Maybe()
+			api.On("RemoveUserCustomStatus", "alice").Return(nil).Maybe()
+			api.On("KVSet", customStatusKeyPrefix+"alice", mock.Anything).Return(nil).Maybe()
+			api.On("KVDelete", customStatusKeyPrefix+"alice").Return(nil).Maybe()
+			p := &Plugin{}
+			p.SetAPI(api)
+
+			action, err := p.syncCustomStatus("alice", tc.want)
+			if err != nil || action != tc.expectedAction {
+				t.Logf("expected action %q, got %q (error %v)", tc.expectedAction, action, err)
+				t.Fail()
+			}
+			for _, method := range []string{"UpdateUserCustomStatus", "RemoveUserCustomStatus", "KVSet", "KVDelete"} {
+				expected := false
+				for _, call := range tc.expectedCalls {
+					expected = expected || call == method
+				}
+				called := false
+				for _, call := range api.Calls {
+					called = called || call.Method == method
+				}
+				if called != expected {
+					t.Logf("expected %s called %v, got %v", method, expected, called)
+					t.Fail()
+				}
+			}
+		})
+	}
+}
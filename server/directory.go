@@ -0,0 +1,300 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/imc/mattermost-plugin-pingboard/server/pingboard"
+)
+
+// directory is a snapshot of the resolved Pingboard data, indexed for lookups.
+// It is built once per refresh and never modified afterwards, so it can be
+// read without holding any lock once obtained from getDirectory.
+// Users are keyed by their (immutable) mattermost user ID; usernames are looked up
+// when the data is read.
+type directory struct {
+	version     string // identifies this snapshot
+	builtAt     time.Time
+	usersById   map[string]User
+	reportsById map[string][]string
+	roots       []string // users without a manager in Pingboard
+	orphans     []string // users whose Pingboard manager is not a known Mattermost user
+	cycles      []string // one user from each loop in the reporting lines
+	search      *searchIndex
+	departments map[string]*department // by lowercase name
+
+	// the mattermost teams of each user at refresh time, or nil if they could not be read
+	teamIdsByUserId map[string]map[string]bool
+
+	// the data the directory was resolved from, kept for matching users created later
+	pingboardData              *pingboardData
+	mmUserIdsByNormalisedEmail map[string]string
+}
+
+type department struct {
+	name      string
+	memberIds []string
+	headId    string // the highest-ranking member
+}
+
+type orgChartNode struct {
+	UserId     string          `json:"user_id"`
+	Username   string          `json:"username"`
+	JobTitle   string          `json:"job_title"`
+	Department string          `json:"department"`
+	Reports    []*orgChartNode `json:"reports"`
+	Truncated  bool            `json:"truncated"` // reports exist below the depth limit
+
+	truncatedIds []string // the reports left out at the depth limit
+}
+
+func newDirectory(usersById map[string]User) *directory {
+	reportsById := map[string][]string{}
+	roots := []string{}
+	orphans := []string{}
+	for userId, user := range usersById {
+		if _, found := usersById[user.ManagerId]; !found {
+			if user.hasPingboardManager {
+				orphans = append(orphans, userId)
+			} else {
+				roots = append(roots, userId)
+			}
+		}
+		if user.ManagerId == "" {
+			continue
+		}
+		reportsById[user.ManagerId] = append(reportsById[user.ManagerId], userId)
+	}
+	for _, reports := range reportsById {
+		sort.Strings(reports)
+	}
+	sort.Strings(roots)
+	sort.Strings(orphans)
+	cycles := findCycles(usersById, reportsById, append(append([]string{}, roots...), orphans...))
+
+	builtAt := time.Now()
+	dir := &directory{
+		version:     strconv.FormatInt(builtAt.UnixNano(), 36),
+		builtAt:     builtAt,
+		usersById:   usersById,
+		reportsById: reportsById,
+		roots:       roots,
+		orphans:     orphans,
+		cycles:      cycles,
+		search:      newSearchIndex(usersById),
+	}
+	dir.departments = dir.resolveDepartments()
+	return dir
+}
+
+// findCycles returns one user, the first by ID, from each loop in the reporting lines.
+// Users in a loop, and everyone below them, cannot be reached from the top of the
+// organisation, so the loops are found among the users not reached from the given tops.
+func findCycles(usersById map[string]User, reportsById map[string][]string, tops []string) []string {
+	reached := map[string]bool{}
+	reach := func(userId string) {
+		queue := []string{userId}
+		reached[userId] = true
+		for len(queue) > 0 {
+			next := queue[0]
+			queue = queue[1:]
+			for _, report := range reportsById[next] {
+				if !reached[report] {
+					reached[report] = true
+					queue = append(queue, report)
+				}
+			}
+		}
+	}
+	for _, userId := range tops {
+		reach(userId)
+	}
+
+	userIds := make([]string, 0, len(usersById))
+	for userId := range usersById {
+		userIds = append(userIds, userId)
+	}
+	sort.Strings(userIds)
+	cycles := []string{}
+	for _, userId := range userIds {
+		if reached[userId] {
+			continue
+		}
+		// walk up until a manager repeats; from there on the chain is the loop
+		position := map[string]int{}
+		chain := []string{}
+		for current := userId; ; current = usersById[current].ManagerId {
+			if _, seen := position[current]; seen {
+				loop := append([]string{}, chain[position[current]:]...)
+				sort.Strings(loop)
+				cycles = append(cycles, loop[0])
+				reach(loop[0])
+				break
+			}
+			position[current] = len(chain)
+			chain = append(chain, current)
+		}
+	}
+	sort.Strings(cycles)
+	return cycles
+}
+
+// resolveDepartments groups the users by department. The head of a department is the
+// member with the fewest managers above them, or if there are several, the one with the
+// most reports in the department.
+func (d *directory) resolveDepartments() map[string]*department {
+	departments := map[string]*department{}
+	for userId, user := range d.usersById {
+		if user.Department == "" || user.Department == pingboard.UnknownDepartment {
+			continue
+		}
+		key := strings.ToLower(user.Department)
+		if departments[key] == nil {
+			departments[key] = &department{name: user.Department}
+		}
+		departments[key].memberIds = append(departments[key].memberIds, userId)
+	}
+
+	for key, dept := range departments {
+		sort.Strings(dept.memberIds)
+		headRank := 0
+		headReports := 0
+		for _, userId := range dept.memberIds {
+			chain, _ := d.managementChain(userId)
+			reports := 0
+			for _, reportIds := range [][]string{d.directReports(userId), d.indirectReports(userId)} {
+				for _, reportId := range reportIds {
+					if strings.ToLower(d.usersById[reportId].Department) == key {
+						reports++
+					}
+				}
+			}
+			if dept.headId == "" || len(chain) < headRank || (len(chain) == headRank && reports > headReports) {
+				dept.headId = userId
+				headRank = len(chain)
+				headReports = reports
+			}
+		}
+	}
+	return departments
+}
+
+// sortedDepartments returns the departments ordered by name.
+func (d *directory) sortedDepartments() []*department {
+	departments := make([]*department, 0, len(d.departments))
+	for _, dept := range d.departments {
+		departments = append(departments, dept)
+	}
+	sort.Slice(departments, func(i, j int) bool {
+		return strings.ToLower(departments[i].name) < strings.ToLower(departments[j].name)
+	})
+	return departments
+}
+
+func (d *directory) user(userId string) (User, bool) {
+	user, found := d.usersById[userId]
+	return user, found
+}
+
+// managementChain returns the user IDs of the user's manager, their manager and so
+// on up to the top of the organisation. If the chain loops back on itself, it is cut
+// at the first repeated user and cycle is returned as true.
+func (d *directory) managementChain(userId string) (chain []string, cycle bool) {
+	chain = []string{}
+	seen := map[string]bool{userId: true}
+	for {
+		user, found := d.usersById[userId]
+		if !found || user.ManagerId == "" {
+			return chain, false
+		}
+		if seen[user.ManagerId] {
+			return chain, true
+		}
+		seen[user.ManagerId] = true
+		chain = append(chain, user.ManagerId)
+		userId = user.ManagerId
+	}
+}
+
+func (d *directory) directReports(userId string) []string {
+	reports := d.reportsById[userId]
+	if reports == nil {
+		return []string{}
+	}
+	return reports
+}
+
+// indirectReports returns everyone below the user's direct reports in the reporting
+// tree, in breadth-first order.
+func (d *directory) indirectReports(userId string) []string {
+	indirect := []string{}
+	seen := map[string]bool{userId: true}
+	queue := []string{}
+	for _, report := range d.directReports(userId) {
+		seen[report] = true
+		queue = append(queue, report)
+	}
+	for len(queue) > 0 {
+		next := queue[0]
+		queue = queue[1:]
+		for _, report := range d.directReports(next) {
+			if seen[report] {
+				continue
+			}
+			seen[report] = true
+			indirect = append(indirect, report)
+			queue = append(queue, report)
+		}
+	}
+	return indirect
+}
+
+// orgChart returns the reporting tree below the given user, going at most depth
+// levels down (a depth of 0 means no limit). Users already placed in the tree are
+// not repeated, so cycles in the reporting lines cannot make it loop.
+func (d *directory) orgChart(userId string, depth int) *orgChartNode {
+	return d.orgChartNode(userId, depth, map[string]bool{})
+}
+
+func (d *directory) orgChartNode(userId string, depth int, seen map[string]bool) *orgChartNode {
+	seen[userId] = true
+	user := d.usersById[userId]
+	node := &orgChartNode{
+		UserId:     userId,
+		JobTitle:   user.JobTitle,
+		Department: user.Department,
+		Reports:    []*orgChartNode{},
+	}
+	for _, report := range d.directReports(userId) {
+		if seen[report] {
+			continue
+		}
+		if depth == 1 {
+			node.truncatedIds = append(node.truncatedIds, report)
+			node.Truncated = true
+			continue
+		}
+		nextDepth := 0
+		if depth > 1 {
+			nextDepth = depth - 1
+		}
+		node.Reports = append(node.Reports, d.orgChartNode(report, nextDepth, seen))
+	}
+	return node
+}
+
+func (p *Plugin) getDirectory() *directory {
+	p.directoryLock.RLock()
+	defer p.directoryLock.RUnlock()
+
+	return p.directory
+}
+
+func (p *Plugin) setDirectory(directory *directory) {
+	p.directoryLock.Lock()
+	defer p.directoryLock.Unlock()
+
+	p.directory = directory
+}
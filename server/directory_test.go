@@ -0,0 +1,220 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/imc/mattermost-plugin-pingboard/server/pingboard"
+)
+
+func TestManagementChain(t *testing.T) {
+	for name, tc := range map[string]struct {
+		managers      map[string]string
+		userId        string
+		expectedChain []string
+		expectedCycle bool
+	}{
+		"unknown user": {
+			managers:      map[string]string{"alice": ""},
+			userId:        "bob",
+			expectedChain: []string{},
+			expectedCycle: false,
+		},
+		"no manager": {
+			managers:      map[string]string{"alice": ""},
+			userId:        "alice",
+			expectedChain: []string{},
+			expectedCycle: false,
+		},
+		"chain to the top": {
+			managers:      map[string]string{"alice": "", "bob": "alice", "carol": "bob"},
+			userId:        "carol",
+			expectedChain: []string{"bob", "alice"},
+			expectedCycle: false,
+		},
+		"manager not in directory": {
+			managers:      map[string]string{"bob": "alice", "carol": "bob"},
+			userId:        "carol",
+			expectedChain: []string{"bob", "alice"},
+			expectedCycle: false,
+		},
+		"own manager": {
+			managers:      map[string]string{"alice": "alice"},
+			userId:        "alice",
+			expectedChain: []string{},
+			expectedCycle: true,
+		},
+		"cycle above user": {
+			managers:      map[string]string{"alice": "bob", "bob": "carol", "carol": "alice", "dave": "alice"},
+			userId:        "dave",
+			expectedChain: []string{"alice", "bob", "carol"},
+			expectedCycle: true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			chain, cycle := testDirectory(tc.managers).managementChain(tc.userId)
+
+			if cycle != tc.expectedCycle {
+				t.Logf("expected cycle: %v, got %v", tc.expectedCycle, cycle)
+				t.Fail()
+			}
+			if !reflect.DeepEqual(chain, tc.expectedChain) {
+				t.Logf("expected chain: %v, got %v", tc.expectedChain, chain)
+				t.Fail()
+			}
+		})
+	}
+}
+
+func TestReports(t *testing.T) {
+	for name, tc := range map[string]struct {
+		managers         map[string]string
+		userId           string
+		expectedDirect   []string
+		expectedIndirect []string
+	}{
+		"no reports": {
+			managers:         map[string]string{"alice": ""},
+			userId:           "alice",
+			expectedDirect:   []string{},
+			expectedIndirect: []string{},
+		},
+		"direct and indirect reports": {
+			managers:         map[string]string{"alice": "", "bob": "alice", "carol": "alice", "dave": "bob", "erin": "dave"},
+			userId:           "alice",
+			expectedDirect:   []string{"bob", "carol"},
+			expectedIndirect: []string{"dave", "erin"},
+		},
+		"cycle": {
+			managers:         map[string]string{"alice": "carol", "bob": "alice", "carol": "bob"},
+			userId:           "alice",
+			expectedDirect:   []string{"bob"},
+			expectedIndirect: []string{"carol"},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := testDirectory(tc.managers)
+
+			if direct := dir.directReports(tc.userId); !reflect.DeepEqual(direct, tc.expectedDirect) {
+				t.Logf("expected direct reports: %v, got %v", tc.expectedDirect, direct)
+				t.Fail()
+			}
+			if indirect := dir.indirectReports(tc.userId); !reflect.DeepEqual(indirect, tc.expectedIndirect) {
+				t.Logf("expected indirect reports: %v, got %v", tc.expectedIndirect, indirect)
+				t.Fail()
+			}
+		})
+	}
+}
+
+func testDirectory(managers map[string]string) *directory {
+	usersById := map[string]User{}
+	for userId, managerId := range managers {
+		usersById[userId] = User{ManagerId: managerId}
+	}
+	return newDirectory(usersById)
+}
+
+func TestRootsAndOrphans(t *testing.T) {
+	dir := newDirectory(map[string]User{
+		"alice": {},
+		"bob":   {ManagerId: "alice", hasPingboardManager: true},
+		"carol": {hasPingboardManager: true},
+	})
+
+	if expected := []string{"alice"}; !reflect.DeepEqual(dir.roots, expected) {
+		t.Logf("expected roots: %v, got %v", expected, dir.roots)
+		t.Fail()
+	}
+	if expected := []string{"carol"}; !reflect.DeepEqual(dir.orphans, expected) {
+		t.Logf("expected orphans: %v, got %v", expected, dir.orphans)
+		t.Fail()
+	}
+}
+
+func TestOrgChartDepth(t *testing.T) {
+	dir := testDirectory(map[string]string{"alice": "", "bob": "alice", "carol": "bob"})
+
+	for depth, expectedLevels := range map[int]int{0: 3, 1: 1, 2: 2, 5: 3} {
+		node := dir.orgChart("alice", depth)
+		levels := 1
+		for len(node.Reports) > 0 {
+			node = node.Reports[0]
+			levels++
+		}
+		if levels != expectedLevels {
+			t.Logf("depth %d: expected %d levels, got %d", depth, expectedLevels, levels)
+			t.Fail()
+		}
+		if expectedTruncated := expectedLevels < 3; node.Truncated != expectedTruncated {
+			t.Logf("depth %d: expected truncated %v, got %v", depth, expectedTruncated, node.Truncated)
+			t.Fail()
+		}
+	}
+}
+
+func TestDepartments(t *testing.T) {
+	dir := newDirectory(map[string]User{
+		"ceo":   {Department: "Board"},
+		"cto":   {ManagerId: "ceo", Department: "Technology"},
+		"lead1": {ManagerId: "cto", Department: "technology"},
+		"lead2": {ManagerId: "cto", Department: "Technology"},
+		"dev1":  {ManagerId: "lead1", Department: "Technology"},
+		"dev2":  {ManagerId: "lead2", Department: "Technology"},
+		"dev3":  {ManagerId: "lead2", Department: "Technology"},
+		"ops":   {ManagerId: "ceo", Department: pingboard.UnknownDepartment},
+	})
+
+	if len(dir.departments) != 2 {
+		t.Logf("expected 2 departments, got %d", len(dir.departments))
+		t.FailNow()
+	}
+	technology := dir.departments["technology"]
+	if expected := []string{"cto", "dev1", "dev2", "dev3", "lead1", "lead2"}; !reflect.DeepEqual(technology.memberIds, expected) {
+		t.Logf("expected members: %v, got %v", expected, technology.memberIds)
+		t.Fail()
+	}
+	if technology.headId != "cto" {
+		t.Logf("expected head cto, got %s", technology.headId)
+		t.Fail()
+	}
+
+	// without the CTO, the lead with the most reports is the head
+	delete(dir.usersById, "cto")
+	if departments := dir.resolveDepartments(); departments["technology"].headId != "lead2" {
+		t.Logf("expected head lead2, got %s", departments["technology"].headId)
+		t.Fail()
+	}
+}
+
+func TestCycles(t *testing.T) {
+	for name, tc := range map[string]struct {
+		managers map[string]string
+		expected []string
+	}{
+		"no loops": {
+			managers: map[string]string{"alice": "", "bob": "alice"},
+			expected: []string{},
+		},
+		"two users managing each other": {
+			managers: map[string]string{"alice": "", "bob": "carol", "carol": "bob"},
+			expected: []string{"bob"},
+		},
+		"loop with users below it": {
+			managers: map[string]string{"alice": "dave", "bob": "carol", "carol": "dave", "dave": "bob", "erin": "alice"},
+			expected: []string{"bob"},
+		},
+		"self-managed user and a separate loop": {
+			managers: map[string]string{"alice": "alice", "bob": "carol", "carol": "bob"},
+			expected: []string{"alice", "bob"},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir := testDirectory(tc.managers)
+			if !reflect.DeepEqual(dir.cycles, tc.expected) {
+				t.Logf("expected cycles: %v, got %v", tc.expected, dir.cycles)
+				t.Fail()
+			}
+		})
+	}
+}
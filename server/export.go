@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Users are only matched to Pingboard by normalised email address, both on refresh and
+// when they are created.
+const matchStrategyEmail = "normalised_email"
+
+// exportRecord is a user in the directory export, linking the Mattermost account to the
+// Pingboard record it was matched with.
+type exportRecord struct {
+	UserId          string `json:"user_id"`
+	Username        string `json:"username"`
+	PingboardId     string `json:"pingboard_id"`
+	MatchStrategy   string `json:"match_strategy"`
+	Email           string `json:"email"`
+	FirstName       string `json:"first_name"`
+	LastName        string `json:"last_name"`
+	Nickname        string `json:"nickname"`
+	JobTitle        string `json:"job_title"`
+	Department      string `json:"department"`
+	Location        string `json:"location"`
+	Phone           string `json:"phone"`
+	StartDate       string `json:"start_date"` // YYYY-MM-DD, or empty if unknown
+	ManagerId       string `json:"manager_id"`
+	Manager         string `json:"manager"`
+	PingboardUrl    string `json:"pingboard_url"`
+	PingboardActive bool   `json:"pingboard_active"`
+}
+
+var exportColumns = []string{
+	"user_id", "username", "pingboard_id", "match_strategy", "email", "first_name", "last_name", "nickname",
+	"job_title", "department", "location", "phone", "start_date", "manager_id", "manager", "pingboard_url",
+	"pingboard_active",
+}
+
+// csvRow returns the record's values in the order of exportColumns.
+func (record exportRecord) csvRow() []string {
+	row := []string{
+		record.UserId, record.Username, record.PingboardId, record.MatchStrategy, record.Email, record.FirstName,
+		record.LastName, record.Nickname, record.JobTitle, record.Department, record.Location, record.Phone,
+		record.StartDate, record.ManagerId, record.Manager, record.PingboardUrl,
+		strconv.FormatBool(record.PingboardActive),
+	}
+	for i, value := range row {
+		row[i] = csvCell(value)
+	}
+	return row
+}
+
+// csvCell escapes a value that a spreadsheet would otherwise run as a formula, such as a
+// job title of "=HYPERLINK(...)" entered in Pingboard, by prefixing it with a quote.
+func csvCell(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+func newExportRecord(dir *directory, userId string, user User, usernames *usernameCache) exportRecord {
+	record := exportRecord{
+		UserId:          userId,
+		Username:        usernames.username(userId),
+		PingboardId:     user.Id,
+		MatchStrategy:   matchStrategyEmail,
+		Email:           user.Email,
+		FirstName:       user.FirstName,
+		LastName:        user.LastName,
+		Nickname:        user.Nickname,
+		JobTitle:        user.JobTitle,
+		Department:      user.Department,
+		Location:        user.Location,
+		Phone:           user.Phone,
+		ManagerId:       user.ManagerId,
+		PingboardUrl:    user.Url,
+		PingboardActive: true,
+	}
+	if user.StartYear > 0 {
+		record.StartDate = fmt.Sprintf("%04d-%02d-%02d", user.StartYear, user.StartMonth, user.StartDay)
+	}
+	if user.ManagerId != "" {
+		record.Manager = usernames.username(user.ManagerId)
+	}
+	if dir.pingboardData != nil {
+		record.PingboardActive = !dir.pingboardData.usersById[user.Id].Inactive
+	}
+	return record
+}
+
+// handleGetExport streams every user in the current directory as CSV (the default) or as
+// newline-delimited JSON. The snapshot the export was made from is described in the
+// response headers.
+func (p *Plugin) handleGetExport(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "ndjson" {
+		p.writeApiError(w, http.StatusBadRequest, "format must be csv or ndjson")
+		return
+	}
+
+	dir := p.getDirectory()
+	if dir == nil {
+		p.API.LogDebug("Returning not found for export (no pingboard data)")
+		p.writeApiError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	userIds := make([]string, 0, len(dir.usersById))
+	for userId := range dir.usersById {
+		userIds = append(userIds, userId)
+	}
+	sort.Strings(userIds)
+
+	w.Header().Set("X-Snapshot-Version", dir.version)
+	w.Header().Set("X-Snapshot-Time", dir.builtAt.UTC().Format(time.RFC3339))
+	w.Header().Set("X-Snapshot-Users", strconv.Itoa(len(userIds)))
+	if dir.pingboardData != nil {
+		w.Header().Set("X-Snapshot-Pingboard-Users", strconv.Itoa(len(dir.pingboardData.usersById)))
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q",
+		fmt.Sprintf("pingboard-directory-%s.%s", dir.builtAt.UTC().Format("20060102T150405Z"), format)))
+	p.API.LogInfo(fmt.Sprintf("Exporting %d users as %s", len(userIds), format),
+		"user_id", r.Header.Get("Mattermost-User-ID"), "snapshot", dir.version)
+
+	p.auditLookups(r, dir.usersById)
+	usernames := p.newUsernameCache()
+	if format == "ndjson" {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		encoder := json.NewEncoder(w)
+		for _, userId := range userIds {
+			if err := encoder.Encode(newExportRecord(dir, userId, dir.usersById[userId], usernames)); err != nil {
+				p.API.LogError("Failed to write export", "error", err)
+				return
+			}
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	writer := csv.NewWriter(w)
+	if err := writer.Write(exportColumns); err != nil {
+		p.API.LogError("Failed to write export", "error", err)
+		return
+	}
+	for _, userId := range userIds {
+		if err := writer.Write(newExportRecord(dir, userId, dir.usersById[userId], usernames).csvRow()); err != nil {
+			p.API.LogError("Failed to write export", "error", err)
+			return
+		}
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		p.API.LogError("Failed to write export", "error", err)
+	}
+}
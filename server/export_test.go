@@ -0,0 +1,53 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExportColumns(t *testing.T) {
+	// The CSV columns are named and ordered like the NDJSON fields
+	recordType := reflect.TypeOf(exportRecord{})
+	jsonNames := []string{}
+	for i := 0; i < recordType.NumField(); i++ {
+		name, _, _ := strings.Cut(recordType.Field(i).Tag.Get("json"), ",")
+		jsonNames = append(jsonNames, name)
+	}
+	if !reflect.DeepEqual(jsonNames, exportColumns) {
+		t.Logf("expected columns %v, got %v", jsonNames, exportColumns)
+		t.Fail()
+	}
+
+	row := exportRecord{UserId: "u1", PingboardActive: true}.csvRow()
+	if len(row) != len(exportColumns) || row[0] != "u1" || row[len(row)-1] != "true" {
+		t.Logf("expected a value for each column, got %v", row)
+		t.Fail()
+	}
+}
+
+func TestCsvRowEscapesFormulas(t *testing.T) {
+	row := exportRecord{
+		FirstName:  "=HYPERLINK(\"http://example.com\")",
+		LastName:   "@SUM(A1)",
+		JobTitle:   "-1+1",
+		Department: "\tTrading",
+		Location:   "\rLondon",
+		Phone:      "+44 20 7946 0000",
+		Nickname:   "Al = Alice",
+	}.csvRow()
+	for column, expected := range map[int]string{
+		5:  "'=HYPERLINK(\"http://example.com\")",
+		6:  "'@SUM(A1)",
+		7:  "Al = Alice",
+		8:  "'-1+1",
+		9:  "'\tTrading",
+		10: "'\rLondon",
+		11: "'+44 20 7946 0000",
+	} {
+		if row[column] != expected {
+			t.Logf("%s: expected %q, got %q", exportColumns[column], expected, row[column])
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/pkg/errors"
+)
+
+// How many times an atomic update is tried while other updates of the same key keep
+// getting in first
+const kvUpdateMaxAttempts = 5
+
+// kvUpdate replaces the value of the key with what update returns for the current value
+// (nil if the key is not set), trying again if another server or request changes the key
+// in the meantime. A non-zero expiry applies to the new value.
+func (p *Plugin) kvUpdate(key string, expiry time.Duration, update func(data []byte) ([]byte, error)) error {
+	for attempt := 0; attempt < kvUpdateMaxAttempts; attempt++ {
+		oldData, appErr := p.API.KVGet(key)
+		if appErr != nil {
+			return appErr
+		}
+		data, err := update(oldData)
+		if err != nil {
+			return err
+		}
+		set, appErr := p.API.KVSetWithOptions(key, data, model.PluginKVSetOptions{
+			Atomic:          true,
+			OldValue:        oldData,
+			ExpireInSeconds: int64(expiry.Seconds()),
+		})
+		if appErr != nil {
+			return appErr
+		}
+		if set {
+			return nil
+		}
+	}
+	return errors.Errorf("%s kept changing", key)
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+// The lookups returned by each request are recorded in KV entries of their own, which
+// expire after the retention window, so that recording a lookup never rewrites earlier
+// ones. Each key holds the time of the request. The keys of the entries written in each
+// hour are listed in an index for that hour, so the entries in a time range can be found
+// by reading the indexes of its hours.
+const lookupAuditKeyPrefix = "lookup_audit_"
+
+const lookupAuditKeyTimeFormat = "20060102150405"
+
+// e.g. lookup_audit_index_2024060112
+const (
+	lookupAuditIndexKeyPrefix     = "lookup_audit_index_"
+	lookupAuditIndexKeyTimeFormat = "2006010215"
+)
+
+const (
+	defaultLookupAuditRetentionDays = 90
+	defaultLookupAuditQueryWindow   = 24 * time.Hour
+
+	// Most records kept in one entry; larger requests, such as exports, use several
+	lookupAuditMaxEntryRecords = 500
+
+	// How many times writing an entry is tried before the lookups are given up on
+	lookupAuditMaxAttempts = 3
+)
+
+// lookupRecord records that a viewer was shown some of the audited fields of a user.
+type lookupRecord struct {
+	Time     time.Time `json:"time"`
+	ViewerId string    `json:"viewer_id"` // mattermost user ID, or plugin:<plugin ID>
+	TargetId string    `json:"target_id"` // mattermost user ID
+	Fields   []string  `json:"fields"`
+	Endpoint string    `json:"endpoint"` // or slash command
+}
+
+// lookupAuditKey returns a new key for an entry of lookups made at the given time.
+func lookupAuditKey(t time.Time) string {
+	return lookupAuditKeyPrefix + t.UTC().Format(lookupAuditKeyTimeFormat) + "_" + model.NewId()
+}
+
+// lookupAuditIndexKey returns the key of the index of the entries written in the hour of
+// the given time.
+func lookupAuditIndexKey(t time.Time) string {
+	return lookupAuditIndexKeyPrefix + t.UTC().Format(lookupAuditIndexKeyTimeFormat)
+}
+
+// lookupAuditKeyTimes returns the span of time in which the lookups in the entry with the
+// given key were made, or false if it is not a lookup audit key.
+func lookupAuditKeyTimes(key string) (time.Time, time.Time, bool) {
+	suffix, found := strings.CutPrefix(key, lookupAuditKeyPrefix)
+	if !found {
+		return time.Time{}, time.Time{}, false
+	}
+	timestamp, _, _ := strings.Cut(suffix, "_")
+	if start, err := time.Parse(lookupAuditKeyTimeFormat, timestamp); err == nil {
+		return start, start.Add(time.Second), true
+	}
+	return time.Time{}, time.Time{}, false
+}
+
+func (c *configuration) lookupAuditRetention() time.Duration {
+	days := c.LookupAuditRetentionDays
+	if days <= 0 {
+		days = defaultLookupAuditRetentionDays
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
+
+// lookupAuditFields returns the configured fields whose lookups are recorded.
+func (c *configuration) lookupAuditFields() map[string]bool {
+	fields := map[string]bool{}
+	for _, field := range strings.Split(c.LookupAuditFields, ",") {
+		if field = strings.ToLower(strings.TrimSpace(field)); field != "" {
+			fields[field] = true
+		}
+	}
+	return fields
+}
+
+// returnedFields returns the fields of the user's data that are set, by the names used
+// in the visibility settings.
+func returnedFields(user User) []string {
+	fields := []string{}
+	for _, field := range []struct {
+		name string
+		set  bool
+	}{
+		{visibleFieldName, user.FirstName != "" || user.LastName != "" || user.Nickname != ""},
+		{visibleFieldJobTitle, user.JobTitle != ""},
+		{visibleFieldDepartment, user.Department != ""},
+		{visibleFieldLocation, user.Location != ""},
+		{visibleFieldManager, user.ManagerId != ""},
+		{visibleFieldStartDate, user.StartYear > 0},
+		{visibleFieldPhone, user.Phone != ""},
+		{visibleFieldEmail, user.Email != ""},
+	} {
+		if field.set {
+			fields = append(fields, field.name)
+		}
+	}
+	return fields
+}
+
+// managerLookups returns the given users with only their managers, for auditing responses
+// that show who users report to without the rest of their data.
+func managerLookups(dir *directory, userIds []string) map[string]User {
+	usersById := map[string]User{}
+	for _, userId := range userIds {
+		usersById[userId] = User{ManagerId: dir.usersById[userId].ManagerId}
+	}
+	return usersById
+}
+
+// departmentLookups returns the given users with only their departments, for auditing
+// responses that list the users in departments.
+func departmentLookups(dir *directory, userIds []string) map[string]User {
+	usersById := map[string]User{}
+	for _, userId := range userIds {
+		usersById[userId] = User{Department: dir.usersById[userId].Department}
+	}
+	return usersById
+}
+
+// orgChartLookups returns the users in the org chart with the fields it shows of them, for
+// auditing.
+func orgChartLookups(tree []*orgChartNode) map[string]User {
+	usersById := map[string]User{}
+	var add func(node *orgChartNode, managerId string)
+	add = func(node *orgChartNode, managerId string) {
+		usersById[node.UserId] = User{JobTitle: node.JobTitle, Department: node.Department, ManagerId: managerId}
+		for _, report := range node.Reports {
+			add(report, node.UserId)
+		}
+	}
+	for _, node := range tree {
+		add(node, "")
+	}
+	return usersById
+}
+
+// auditLookups records which of the audited fields of the given users, as returned in
+// response to the request, were looked up.
+func (p *Plugin) auditLookups(r *http.Request, usersById map[string]User) {
+	viewerId := r.Header.Get("Mattermost-User-ID")
+	if isPluginRequest(r) {
+		viewerId = "plugin:" + r.Header.Get(pluginIdHeader)
+	}
+	p.recordLookups(viewerId, r.URL.Path, usersById)
+}
+
+// recordLookups records which of the audited fields of the given users, as shown to the
+// viewer, were looked up, if enabled in the configuration. Failures are logged, and do not
+// fail the lookup.
+func (p *Plugin) recordLookups(viewerId string, endpoint string, usersById map[string]User) {
+	config := p.getConfiguration()
+	if !config.LookupAuditEnabled {
+		return
+	}
+	audited := config.lookupAuditFields()
+
+	now := time.Now()
+	records := []lookupRecord{}
+	for userId, user := range usersById {
+		fields := []string{}
+		for _, field := range returnedFields(user) {
+			if audited[field] {
+				fields = append(fields, field)
+			}
+		}
+		if len(fields) > 0 {
+			records = append(records, lookupRecord{
+				Time:     now,
+				ViewerId: viewerId,
+				TargetId: userId,
+				Fields:   fields,
+				Endpoint: endpoint,
+			})
+		}
+	}
+	if len(records) == 0 {
+		return
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].TargetId < records[j].TargetId })
+
+	keys := []string{}
+	for len(records) > 0 {
+		entry := records[:min(len(records), lookupAuditMaxEntryRecords)]
+		records = records[len(entry):]
+		key := lookupAuditKey(now)
+		if err := p.writeLookupAudit(key, entry, config.lookupAuditRetention()); err != nil {
+			p.API.LogError("Failed to write lookup audit log", "viewer_id", viewerId, "records", len(entry), "error", err)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	if len(keys) == 0 {
+		return
+	}
+	// the index outlives the entries it lists, which expire up to an hour after it is created
+	err := p.kvUpdate(lookupAuditIndexKey(now), config.lookupAuditRetention()+time.Hour, func(data []byte) ([]byte, error) {
+		index := []string{}
+		if data != nil {
+			if err := json.Unmarshal(data, &index); err != nil {
+				return nil, err
+			}
+		}
+		return json.Marshal(append(index, keys...))
+	})
+	if err != nil {
+		p.API.LogError("Failed to index lookup audit log", "viewer_id", viewerId, "keys", len(keys), "error", err)
+	}
+}
+
+// writeLookupAudit writes an entry of lookup records, trying again if that fails.
+func (p *Plugin) writeLookupAudit(key string, records []lookupRecord, retention time.Duration) error {
+	data, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	var appErr *model.AppError
+	for attempt := 0; attempt < lookupAuditMaxAttempts; attempt++ {
+		if _, appErr = p.API.KVSetWithOptions(key, data, model.PluginKVSetOptions{
+			ExpireInSeconds: int64(retention.Seconds()),
+		}); appErr == nil {
+			return nil
+		}
+	}
+	return appErr
+}
+
+// getLookupAudit returns the recorded lookups from since until until, oldest first,
+// optionally only those by the given viewer and/or of the given target.
+func (p *Plugin) getLookupAudit(since time.Time, until time.Time, viewerId string, targetId string) ([]lookupRecord, error) {
+	keys := []string{}
+	for hour := since.Truncate(time.Hour); !hour.After(until); hour = hour.Add(time.Hour) {
+		data, appErr := p.API.KVGet(lookupAuditIndexKey(hour))
+		if appErr != nil {
+			return nil, appErr
+		}
+		if data == nil {
+			continue
+		}
+		index := []string{}
+		if err := json.Unmarshal(data, &index); err != nil {
+			return nil, err
+		}
+		for _, key := range index {
+			if start, end, ok := lookupAuditKeyTimes(key); ok && end.After(since) && !start.After(until) {
+				keys = append(keys, key)
+			}
+		}
+	}
+
+	records := []lookupRecord{}
+	for _, key := range keys {
+		data, appErr := p.API.KVGet(key)
+		if appErr != nil {
+			return nil, appErr
+		}
+		if data == nil {
+			continue // expired before its index
+		}
+		entry := []lookupRecord{}
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return nil, err
+		}
+		for _, record := range entry {
+			if record.Time.Before(since) || record.Time.After(until) ||
+				(viewerId != "" && record.ViewerId != viewerId) || (targetId != "" && record.TargetId != targetId) {
+				continue
+			}
+			records = append(records, record)
+		}
+	}
+	sort.SliceStable(records, func(i, j int) bool { return records[i].Time.Before(records[j].Time) })
+	return records, nil
+}
+
+// timeParam returns the named query parameter as an RFC 3339 time, or defaultValue if it
+// is not given. If it is malformed, an error response has already been written.
+func (p *Plugin) timeParam(w http.ResponseWriter, r *http.Request, name string, defaultValue time.Time) (time.Time, bool) {
+	param := r.URL.Query().Get(name)
+	if param == "" {
+		return defaultValue, true
+	}
+	value, err := time.Parse(time.RFC3339, param)
+	if err != nil {
+		p.API.LogDebug("Returning bad request (malformed "+name+" param)", name, param)
+		p.writeApiError(w, http.StatusBadRequest, name+" must be a time such as 2006-01-02T15:04:05Z")
+		return time.Time{}, false
+	}
+	return value, true
+}
+
+func (p *Plugin) handleGetLookupAudit(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	until, ok := p.timeParam(w, r, "until", now)
+	if !ok {
+		return
+	}
+	// nothing newer than now is recorded yet
+	if until.After(now) {
+		until = now
+	}
+	since, ok := p.timeParam(w, r, "since", until.Add(-defaultLookupAuditQueryWindow))
+	if !ok {
+		return
+	}
+	// nothing older than the retention window is kept
+	if oldest := now.Add(-p.getConfiguration().lookupAuditRetention()); since.Before(oldest) {
+		since = oldest
+	}
+	if until.Before(since) {
+		p.writeApiError(w, http.StatusBadRequest, "since must be before until")
+		return
+	}
+
+	query := r.URL.Query()
+	records, err := p.getLookupAudit(since, until, query.Get("viewer_id"), query.Get("target_id"))
+	if err != nil {
+		p.API.LogError("Failed to read lookup audit log", "error", err)
+		p.writeApiError(w, http.StatusInternalServerError, "failed to read audit log")
+		return
+	}
+	p.API.LogDebug(fmt.Sprintf("Returning %d lookup audit records", len(records)))
+	p.writeApiResponse(w, records)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+func TestReturnedFields(t *testing.T) {
+	for name, tc := range map[string]struct {
+		user     User
+		expected []string
+	}{
+		"nothing": {
+			user:     User{},
+			expected: []string{},
+		},
+		"name from preferred name only": {
+			user:     User{Nickname: "Al"},
+			expected: []string{visibleFieldName},
+		},
+		"phone and email": {
+			user:     User{Phone: "123", Email: "alice@example.com", StartYear: 2020},
+			expected: []string{visibleFieldStartDate, visibleFieldPhone, visibleFieldEmail},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if fields := returnedFields(tc.user); !reflect.DeepEqual(fields, tc.expected) {
+				t.Logf("expected: %v, got %v", tc.expected, fields)
+				t.Fail()
+			}
+		})
+	}
+}
+
+func TestLookupAuditKey(t *testing.T) {
+	// Keys hold the UTC time, whatever the time zone of the time
+	amsterdam := time.FixedZone("CEST", 2*60*60)
+	lookedUpAt := time.Date(2024, 6, 1, 1, 30, 15, 500, amsterdam)
+	key := lookupAuditKey(lookedUpAt)
+	if !strings.HasPrefix(key, "lookup_audit_20240531233015_") || key == lookupAuditKey(lookedUpAt) {
+		t.Logf("expected a new key starting lookup_audit_20240531233015_, got %s", key)
+		t.Fail()
+	}
+
+	for key, expected := range map[string]struct {
+		start time.Time
+		end   time.Time
+		ok    bool
+	}{
+		key: {
+			start: time.Date(2024, 5, 31, 23, 30, 15, 0, time.UTC),
+			end:   time.Date(2024, 5, 31, 23, 30, 16, 0, time.UTC),
+			ok:    true,
+		},
+		"offboarding_state":                  {},
+		"lookup_audit_banana":                {},
+		"lookup_audit_index_2024053123":      {},
+		"lookup_audit_2024053123_legacyhour": {},
+	} {
+		start, end, ok := lookupAuditKeyTimes(key)
+		if !start.Equal(expected.start) || !end.Equal(expected.end) || ok != expected.ok {
+			t.Logf("%s: expected %v-%v %v, got %v-%v %v", key, expected.start, expected.end, expected.ok, start, end, ok)
+			t.Fail()
+		}
+	}
+}
+
+// kvTestAPI is a KV store in memory.
+type kvTestAPI struct {
+	logOnlyAPI
+	values map[string][]byte
+}
+
+func (api *kvTestAPI) KVSetWithOptions(key string, value []byte, options model.PluginKVSetOptions) (bool, *model.AppError) {
+	if options.Atomic && !bytes.Equal(api.values[key], options.OldValue) {
+		return false, nil
+	}
+	api.values[key] = value
+	return true, nil
+}
+
+func (api *kvTestAPI) KVGet(key string) ([]byte, *model.AppError) {
+	return api.values[key], nil
+}
+
+func TestRecordAndGetLookups(t *testing.T) {
+	api := &kvTestAPI{values: map[string][]byte{"offboarding_state": []byte("{}")}}
+	p := &Plugin{configuration: &configuration{LookupAuditEnabled: true, LookupAuditFields: "phone"}}
+	p.SetAPI(api)
+
+	// an export of many users is split over several entries
+	usersById := map[string]User{}
+	for i := 0; i < lookupAuditMaxEntryRecords+10; i++ {
+		usersById[fmt.Sprintf("user%04d", i)] = User{Phone: "123"}
+	}
+	before := time.Now().Add(-time.Second)
+	p.recordLookups("admin", "/export", usersById)
+	p.recordLookups("alice", "/user", map[string]User{"user0001": {Phone: "123"}, "bob": {FirstName: "Bob"}})
+	after := time.Now().Add(time.Second)
+
+	entries := 0
+	for key := range api.values {
+		if _, _, ok := lookupAuditKeyTimes(key); ok {
+			entries++
+		}
+	}
+	if entries != 3 {
+		t.Logf("expected 3 entries, got %d", entries)
+		t.Fail()
+	}
+	for name, tc := range map[string]struct {
+		viewerId string
+		targetId string
+		since    time.Time
+		expected int
+	}{
+		"everything":       {since: before, expected: lookupAuditMaxEntryRecords + 11},
+		"by viewer":        {viewerId: "alice", since: before, expected: 1},
+		"of target":        {targetId: "user0001", since: before, expected: 2},
+		"not audited":      {targetId: "bob", since: before, expected: 0},
+		"before the range": {since: after, expected: 0},
+		"hours before":     {since: before.Add(-5 * time.Hour), expected: lookupAuditMaxEntryRecords + 11},
+	} {
+		t.Run(name, func(t *testing.T) {
+			records, err := p.getLookupAudit(tc.since, after, tc.viewerId, tc.targetId)
+			if err != nil || len(records) != tc.expected {
+				t.Logf("expected %d records, got %d (%v)", tc.expected, len(records), err)
+				t.Fail()
+			}
+		})
+	}
+}
+
+func TestOrgChartLookups(t *testing.T) {
+	tree := []*orgChartNode{{
+		UserId:   "alice",
+		JobTitle: "CEO",
+		Reports: []*orgChartNode{
+			{UserId: "bob", Department: "Sales"},
+			{UserId: "carol", Reports: []*orgChartNode{{UserId: "dave"}}},
+		},
+	}}
+	expected := map[string]User{
+		"alice": {JobTitle: "CEO"},
+		"bob":   {Department: "Sales", ManagerId: "alice"},
+		"carol": {ManagerId: "alice"},
+		"dave":  {ManagerId: "carol"},
+	}
+	if lookups := orgChartLookups(tree); !reflect.DeepEqual(lookups, expected) {
+		t.Logf("expected %v, got %v", expected, lookups)
+		t.Fail()
+	}
+}
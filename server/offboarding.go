@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/imc/mattermost-plugin-pingboard/server/pingboard"
+)
+
+const (
+	offboardingPolicyOff        = "off"
+	offboardingPolicyReport     = "report"
+	offboardingPolicyDeactivate = "deactivate"
+)
+
+const offboardingStateKey = "offboarding_state"
+
+// If more than this fraction of the previously matched users goes missing in a single
+// refresh, something is more likely wrong with the Pingboard data than that they all left.
+const offboardingMaxMissingFraction = 0.5
+
+// Refreshes also run on configuration changes and the refresh command, so a
+// user's missed refreshes are only counted once per refresh interval. The timer runs a
+// little late when a refresh is slow, hence the margin.
+const offboardingMissInterval = refreshInterval - 10*time.Minute
+
+// offboardingState is kept in the KV store so that missed refreshes are counted across
+// plugin restarts.
+type offboardingState struct {
+	// Pingboard IDs by mattermost user ID, of the users who were matched and active in
+	// Pingboard at the last refresh counted (including users whose email no longer matches)
+	MatchedUsers map[string]string                `json:"matched_users"`
+	Candidates   map[string]*offboardingCandidate `json:"candidates"`
+}
+
+type offboardingCandidate struct {
+	UserId          string    `json:"user_id"`
+	Username        string    `json:"username"`
+	PingboardId     string    `json:"pingboard_id"`
+	Reason          string    `json:"reason"` // missing from Pingboard, or inactive there
+	MissedRefreshes int       `json:"missed_refreshes"`
+	FirstMissedAt   time.Time `json:"first_missed_at"`
+	LastMissedAt    time.Time `json:"last_missed_at"`   // when a missed refresh was last counted
+	Due             bool      `json:"due"`              // missed enough refreshes, and the grace period is over
+	Action          string    `json:"action,omitempty"` // what was done about a due candidate
+	Error           string    `json:"error,omitempty"`
+}
+
+// offboardingLostMatch is a user whose Pingboard record is still there, but whose
+// Mattermost email address no longer matches it. They are reported, but never offboarded.
+type offboardingLostMatch struct {
+	UserId      string `json:"user_id"`
+	PingboardId string `json:"pingboard_id"`
+}
+
+type offboardingReport struct {
+	Time        time.Time               `json:"time"`
+	Policy      string                  `json:"policy"`
+	DryRun      bool                    `json:"dry_run"`
+	Skipped     string                  `json:"skipped,omitempty"` // why missed refreshes were not counted
+	Candidates  []*offboardingCandidate `json:"candidates"`
+	LostMatches []offboardingLostMatch  `json:"lost_matches"`
+}
+
+func (p *Plugin) getOffboardingState() (*offboardingState, error) {
+	state := &offboardingState{
+		MatchedUsers: map[string]string{},
+		Candidates:   map[string]*offboardingCandidate{},
+	}
+	data, appErr := p.API.KVGet(offboardingStateKey)
+	if appErr != nil {
+		return nil, appErr
+	}
+	if data == nil {
+		return state, nil
+	}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, err
+	}
+	if state.MatchedUsers == nil {
+		state.MatchedUsers = map[string]string{}
+	}
+	for userId, candidate := range state.Candidates {
+		// candidates recorded before Pingboard IDs were kept start counting again
+		if candidate.PingboardId == "" {
+			delete(state.Candidates, userId)
+		}
+	}
+	return state, nil
+}
+
+func (p *Plugin) setOffboardingState(state *offboardingState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if appErr := p.API.KVSet(offboardingStateKey, data); appErr != nil {
+		return appErr
+	}
+	return nil
+}
+
+// update counts a missed refresh for the users whose Pingboard record has gone, or is
+// inactive, given the Pingboard ID matched to each mattermost user in this refresh.
+// Returns the candidates for offboarding, ordered by user ID, and the users whose email
+// no longer matches a Pingboard record that is still there. If too many users went
+// missing at once, nothing is counted or changed, and the reason is returned instead.
+func (state *offboardingState) update(matched map[string]string, pbUsersById map[string]pingboard.User,
+	now time.Time) ([]*offboardingCandidate, []offboardingLostMatch, string) {
+	// the Pingboard ID of every user known now or at the last refresh
+	pingboardIds := map[string]string{}
+	for userId, candidate := range state.Candidates {
+		pingboardIds[userId] = candidate.PingboardId
+	}
+	for userId, pbId := range state.MatchedUsers {
+		pingboardIds[userId] = pbId
+	}
+	for userId, pbId := range matched {
+		pingboardIds[userId] = pbId
+	}
+
+	gone := map[string]string{} // reason by user ID
+	lostMatches := []offboardingLostMatch{}
+	matchedUsers := map[string]string{}
+	for userId, pbId := range pingboardIds {
+		pbUser, found := pbUsersById[pbId]
+		switch {
+		case !found:
+			gone[userId] = "missing from Pingboard"
+		case pbUser.Inactive:
+			gone[userId] = "inactive in Pingboard"
+		default:
+			matchedUsers[userId] = pbId
+			if _, stillMatched := matched[userId]; !stillMatched {
+				lostMatches = append(lostMatches, offboardingLostMatch{UserId: userId, PingboardId: pbId})
+			}
+		}
+	}
+	sort.Slice(lostMatches, func(i, j int) bool { return lostMatches[i].UserId < lostMatches[j].UserId })
+
+	newlyGone := 0
+	for userId := range gone {
+		if state.Candidates[userId] == nil {
+			newlyGone++
+		}
+	}
+	if len(state.MatchedUsers) > 0 && float64(newlyGone) > offboardingMaxMissingFraction*float64(len(state.MatchedUsers)) {
+		return nil, lostMatches, fmt.Sprintf("%d of %d matched users went missing at once", newlyGone, len(state.MatchedUsers))
+	}
+
+	candidates := []*offboardingCandidate{}
+	for userId := range state.Candidates {
+		if gone[userId] == "" {
+			delete(state.Candidates, userId)
+		}
+	}
+	for userId, reason := range gone {
+		candidate := state.Candidates[userId]
+		if candidate == nil {
+			candidate = &offboardingCandidate{UserId: userId, PingboardId: pingboardIds[userId], FirstMissedAt: now}
+			state.Candidates[userId] = candidate
+		}
+		if candidate.LastMissedAt.IsZero() || now.Sub(candidate.LastMissedAt) >= offboardingMissInterval {
+			candidate.MissedRefreshes++
+			candidate.LastMissedAt = now
+		}
+		candidate.Reason = reason
+		candidate.Due = false
+		candidate.Action = ""
+		candidate.Error = ""
+		candidates = append(candidates, candidate)
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].UserId < candidates[j].UserId })
+	state.MatchedUsers = matchedUsers
+	return candidates, lostMatches, ""
+}
+
+// detectOffboarding counts how many refreshes previously matched users have been missing
+// from Pingboard (or inactive there), and reports or deactivates those who have been gone
+// long enough, according to the configured policy.
+func (p *Plugin) detectOffboarding(dir *directory) {
+	config := p.getConfiguration()
+	if config.OffboardingPolicy != offboardingPolicyReport && config.OffboardingPolicy != offboardingPolicyDeactivate {
+		return
+	}
+
+	state, err := p.getOffboardingState()
+	if err != nil {
+		p.API.LogError("Offboarding: failed to read state", "error", err)
+		return
+	}
+
+	now := time.Now()
+	report := &offboardingReport{
+		Time:   now,
+		Policy: config.OffboardingPolicy,
+		DryRun: config.OffboardingDryRun,
+	}
+
+	matched := map[string]string{}
+	for userId, user := range dir.usersById {
+		matched[userId] = user.Id
+	}
+	report.Candidates, report.LostMatches, report.Skipped = state.update(matched, dir.pingboardData.usersById, now)
+	for _, lostMatch := range report.LostMatches {
+		p.API.LogWarn("Offboarding: user's email no longer matches their Pingboard record",
+			"user_id", lostMatch.UserId, "pingboard_id", lostMatch.PingboardId)
+	}
+	if report.Skipped != "" {
+		p.API.LogWarn("Offboarding: not counting missed refreshes, " + report.Skipped)
+		report.Candidates = []*offboardingCandidate{}
+		p.setOffboardingReport(report)
+		return
+	}
+
+	report.Candidates = p.reviewOffboardingCandidates(config, state, report.Candidates, now)
+	if err := p.setOffboardingState(state); err != nil {
+		p.API.LogError("Offboarding: failed to write state", "error", err)
+	}
+
+	p.API.LogInfo(fmt.Sprintf("Offboarding: %d users missing or inactive in Pingboard", len(report.Candidates)),
+		"policy", report.Policy, "dry_run", report.DryRun)
+	p.setOffboardingReport(report)
+}
+
+// reviewOffboardingCandidates acts on the candidates that are due, and stops tracking
+// those that are already deactivated, bots or excluded. Returns the candidates still
+// tracked or acted on.
+func (p *Plugin) reviewOffboardingCandidates(config *configuration, state *offboardingState,
+	candidates []*offboardingCandidate, now time.Time) []*offboardingCandidate {
+	reviewed := []*offboardingCandidate{}
+	excluded := map[string]bool{}
+	for _, username := range strings.Split(config.OffboardingExcludedUsers, ",") {
+		if username = strings.ToLower(strings.TrimSpace(username)); username != "" {
+			excluded[username] = true
+		}
+	}
+	grace := time.Duration(config.OffboardingGraceDays) * 24 * time.Hour
+
+	for _, candidate := range candidates {
+		mmUser, appErr := p.API.GetUser(candidate.UserId)
+		if appErr != nil {
+			candidate.Error = appErr.Error()
+			reviewed = append(reviewed, candidate)
+			continue
+		}
+		candidate.Username = mmUser.Username
+		if mmUser.DeleteAt != 0 || mmUser.IsBot || excluded[mmUser.Username] {
+			// nothing (more) to do for this user
+			delete(state.Candidates, candidate.UserId)
+			continue
+		}
+
+		candidate.Due = candidate.MissedRefreshes >= config.OffboardingMissedRefreshes &&
+			now.Sub(candidate.FirstMissedAt) >= grace
+		if candidate.Due {
+			p.offboard(config, candidate)
+			if candidate.Action == "deactivated" {
+				delete(state.Candidates, candidate.UserId)
+			}
+		}
+		reviewed = append(reviewed, candidate)
+	}
+	return reviewed
+}
+
+// offboard acts on a candidate that is due, recording what was done.
+func (p *Plugin) offboard(config *configuration, candidate *offboardingCandidate) {
+	if config.OffboardingPolicy != offboardingPolicyDeactivate {
+		candidate.Action = "reported"
+		p.API.LogWarn(fmt.Sprintf("Offboarding: user %s is %s", candidate.Username, candidate.Reason),
+			"user_id", candidate.UserId, "missed_refreshes", candidate.MissedRefreshes)
+		return
+	}
+	if config.OffboardingDryRun {
+		candidate.Action = "would deactivate"
+		p.API.LogInfo(fmt.Sprintf("Offboarding: would deactivate user %s (%s)", candidate.Username, candidate.Reason),
+			"user_id", candidate.UserId)
+		return
+	}
+
+	// deactivating a user also revokes all of their sessions
+	if appErr := p.API.UpdateUserActive(candidate.UserId, false); appErr != nil {
+		candidate.Error = appErr.Error()
+		p.API.LogError("Offboarding: failed to deactivate user", "user_id", candidate.UserId, "error", appErr)
+		return
+	}
+	candidate.Action = "deactivated"
+	p.API.LogInfo(fmt.Sprintf("Offboarding: deactivated user %s (%s)", candidate.Username, candidate.Reason),
+		"user_id", candidate.UserId)
+}
+
+func (p *Plugin) setOffboardingReport(report *offboardingReport) {
+	p.offboardingReportLock.Lock()
+	defer p.offboardingReportLock.Unlock()
+
+	p.offboardingReport = report
+}
+
+func (p *Plugin) handleGetOffboardingReport(w http.ResponseWriter, r *http.Request) {
+	p.offboardingReportLock.RLock()
+	report := p.offboardingReport
+	p.offboardingReportLock.RUnlock()
+	if report == nil {
+		p.writeApiError(w, http.StatusNotFound, "not found")
+		return
+	}
+	p.writeApiResponse(w, report)
+}
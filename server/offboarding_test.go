@@ -0,0 +1,210 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+
+	"github.com/imc/mattermost-plugin-pingboard/server/pingboard"
+)
+
+func TestOffboardingStateUpdate(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	pbUsersById := map[string]pingboard.User{
+		"pb-alice": {Id: "pb-alice"},
+		"pb-bob":   {Id: "pb-bob", Inactive: true},
+		"pb-carol": {Id: "pb-carol"},
+		"pb-dave":  {Id: "pb-dave"},
+	}
+	for name, tc := range map[string]struct {
+		state              offboardingState
+		matched            map[string]string
+		expectedCandidates map[string]int // missed refreshes by user ID
+		expectedLost       []offboardingLostMatch
+		expectedSkipped    bool
+	}{
+		"missing and inactive": {
+			state: offboardingState{
+				MatchedUsers: map[string]string{"alice": "pb-alice", "carol": "pb-carol", "dave": "pb-dave", "erin": "pb-erin"},
+			},
+			matched:            map[string]string{"alice": "pb-alice", "bob": "pb-bob", "carol": "pb-carol", "dave": "pb-dave"},
+			expectedCandidates: map[string]int{"bob": 1, "erin": 1},
+		},
+		"email no longer matching": {
+			state: offboardingState{
+				MatchedUsers: map[string]string{"alice": "pb-alice", "carol": "pb-carol", "dave": "pb-dave"},
+			},
+			matched:            map[string]string{"carol": "pb-carol", "dave": "pb-dave"},
+			expectedCandidates: map[string]int{},
+			expectedLost:       []offboardingLostMatch{{UserId: "alice", PingboardId: "pb-alice"}},
+		},
+		"back in pingboard": {
+			state: offboardingState{
+				MatchedUsers: map[string]string{"carol": "pb-carol"},
+				Candidates: map[string]*offboardingCandidate{
+					"alice": {UserId: "alice", PingboardId: "pb-alice", MissedRefreshes: 2, LastMissedAt: now.Add(-refreshInterval)},
+				},
+			},
+			matched:            map[string]string{"alice": "pb-alice", "carol": "pb-carol"},
+			expectedCandidates: map[string]int{},
+		},
+		"counted once per refresh interval": {
+			state: offboardingState{
+				MatchedUsers: map[string]string{"alice": "pb-alice"},
+				Candidates: map[string]*offboardingCandidate{
+					"erin":  {UserId: "erin", PingboardId: "pb-erin", MissedRefreshes: 2, LastMissedAt: now.Add(-time.Hour)},
+					"frank": {UserId: "frank", PingboardId: "pb-frank", MissedRefreshes: 2, LastMissedAt: now.Add(-refreshInterval)},
+				},
+			},
+			matched:            map[string]string{"alice": "pb-alice"},
+			expectedCandidates: map[string]int{"erin": 2, "frank": 3},
+		},
+		"too many missing at once": {
+			state: offboardingState{
+				MatchedUsers: map[string]string{"alice": "pb-alice", "erin": "pb-erin", "frank": "pb-frank"},
+			},
+			matched:         map[string]string{"alice": "pb-alice"},
+			expectedSkipped: true,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			state := tc.state
+			if state.Candidates == nil {
+				state.Candidates = map[string]*offboardingCandidate{}
+			}
+			candidates, lost, skipped := state.update(tc.matched, pbUsersById, now)
+			if (skipped != "") != tc.expectedSkipped {
+				t.Logf("expected skipped %v, got %q", tc.expectedSkipped, skipped)
+				t.Fail()
+			}
+			if tc.expectedSkipped {
+				if len(state.Candidates) != 0 || !reflect.DeepEqual(state.MatchedUsers, tc.state.MatchedUsers) {
+					t.Logf("expected the state not to change, got %+v", state)
+					t.Fail()
+				}
+				return
+			}
+			missed := map[string]int{}
+			for _, candidate := range candidates {
+				missed[candidate.UserId] = candidate.MissedRefreshes
+				if state.Candidates[candidate.UserId] != candidate {
+					t.Logf("expected candidate %s to be kept in the state", candidate.UserId)
+					t.Fail()
+				}
+			}
+			if !reflect.DeepEqual(missed, tc.expectedCandidates) || len(state.Candidates) != len(tc.expectedCandidates) {
+				t.Logf("expected candidates %v, got %v (state %v)", tc.expectedCandidates, missed, state.Candidates)
+				t.Fail()
+			}
+			if tc.expectedLost == nil {
+				tc.expectedLost = []offboardingLostMatch{}
+			}
+			if !reflect.DeepEqual(lost, tc.expectedLost) {
+				t.Logf("expected lost matches %v, got %v", tc.expectedLost, lost)
+				t.Fail()
+			}
+		})
+	}
+}
+
+// offboardingTestAPI serves mattermost users, and records which were deactivated.
+type offboardingTestAPI struct {
+	logOnlyAPI
+	usersById   map[string]*model.User
+	deactivated []string
+}
+
+func (api *offboardingTestAPI) GetUser(userId string) (*model.User, *model.AppError) {
+	return api.usersById[userId], nil
+}
+
+func (api *offboardingTestAPI) UpdateUserActive(userId string, active bool) *model.AppError {
+	api.deactivated = append(api.deactivated, userId)
+	return nil
+}
+
+func TestReviewOffboardingCandidates(t *testing.T) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	usersById := map[string]*model.User{
+		"alice": {Id: "alice", Username: "alice"},
+		"bot":   {Id: "bot", Username: "bot", IsBot: true},
+		"gone":  {Id: "gone", Username: "gone", DeleteAt: 1},
+		"vip":   {Id: "vip", Username: "vip"},
+	}
+	for name, tc := range map[string]struct {
+		policy              string
+		dryRun              bool
+		missed              int
+		firstMissedAgo      time.Duration
+		userId              string
+		expectedReported    bool
+		expectedAction      string
+		expectedDeactivated bool
+		expectedKept        bool
+	}{
+		"not enough missed refreshes": {
+			policy: offboardingPolicyDeactivate, missed: 2, firstMissedAgo: 5 * 24 * time.Hour, userId: "alice",
+			expectedReported: true, expectedKept: true,
+		},
+		"grace period not over": {
+			policy: offboardingPolicyDeactivate, missed: 5, firstMissedAgo: 24 * time.Hour, userId: "alice",
+			expectedReported: true, expectedKept: true,
+		},
+		"reported": {
+			policy: offboardingPolicyReport, missed: 3, firstMissedAgo: 2 * 24 * time.Hour, userId: "alice",
+			expectedReported: true, expectedAction: "reported", expectedKept: true,
+		},
+		"dry run": {
+			policy: offboardingPolicyDeactivate, dryRun: true, missed: 3, firstMissedAgo: 2 * 24 * time.Hour, userId: "alice",
+			expectedReported: true, expectedAction: "would deactivate", expectedKept: true,
+		},
+		"deactivated": {
+			policy: offboardingPolicyDeactivate, missed: 3, firstMissedAgo: 2 * 24 * time.Hour, userId: "alice",
+			expectedReported: true, expectedAction: "deactivated", expectedDeactivated: true,
+		},
+		"excluded": {
+			policy: offboardingPolicyDeactivate, missed: 3, firstMissedAgo: 2 * 24 * time.Hour, userId: "vip",
+		},
+		"bot": {
+			policy: offboardingPolicyDeactivate, missed: 3, firstMissedAgo: 2 * 24 * time.Hour, userId: "bot",
+		},
+		"already deactivated": {
+			policy: offboardingPolicyDeactivate, missed: 3, firstMissedAgo: 2 * 24 * time.Hour, userId: "gone",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			api := &offboardingTestAPI{usersById: usersById}
+			p := &Plugin{}
+			p.SetAPI(api)
+			config := &configuration{
+				OffboardingPolicy:          tc.policy,
+				OffboardingDryRun:          tc.dryRun,
+				OffboardingMissedRefreshes: 3,
+				OffboardingGraceDays:       2,
+				OffboardingExcludedUsers:   "someone, VIP",
+			}
+			candidate := &offboardingCandidate{UserId: tc.userId, MissedRefreshes: tc.missed, FirstMissedAt: now.Add(-tc.firstMissedAgo)}
+			state := &offboardingState{Candidates: map[string]*offboardingCandidate{tc.userId: candidate}}
+
+			reviewed := p.reviewOffboardingCandidates(config, state, []*offboardingCandidate{candidate}, now)
+			if (len(reviewed) == 1) != tc.expectedReported {
+				t.Logf("expected reported %v, got %v", tc.expectedReported, reviewed)
+				t.Fail()
+			}
+			if candidate.Action != tc.expectedAction {
+				t.Logf("expected action %q, got %q", tc.expectedAction, candidate.Action)
+				t.Fail()
+			}
+			if (len(api.deactivated) == 1) != tc.expectedDeactivated {
+				t.Logf("expected deactivated %v, got %v", tc.expectedDeactivated, api.deactivated)
+				t.Fail()
+			}
+			if _, kept := state.Candidates[tc.userId]; kept != tc.expectedKept {
+				t.Logf("expected kept %v, got %v", tc.expectedKept, kept)
+				t.Fail()
+			}
+		})
+	}
+}
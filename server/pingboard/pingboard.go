@@ -5,20 +5,37 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/go-resty/resty/v2"
 	"github.com/mattermost/mattermost/server/public/plugin"
 )
 
+// Department given to users whose department could not be resolved
+const UnknownDepartment = "(unknown department)"
+
 // Public types returned by this client
 type User struct {
-	Id          string
-	StartDate   string
-	Email       string
-	Phone       string
-	JobTitle    string
-	ReportsToId string
-	Department  string
+	Id            string
+	StartDate     string
+	Email         string
+	FirstName     string
+	LastName      string
+	PreferredName string
+	Phone         string
+	JobTitle      string
+	ReportsToId   string
+	Department    string
+	Location      string
+	Inactive      bool
+}
+
+type Status struct {
+	UserId   string
+	TypeName string
+	Message  string
+	StartsAt time.Time
+	EndsAt   time.Time
 }
 
 type Company struct {
@@ -46,6 +63,13 @@ type groupResponse struct {
 type groupsResponse struct {
 	Groups []groupResponse `json:"groups"`
 }
+type locationResponse struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+}
+type locationsResponse struct {
+	Locations []locationResponse `json:"locations"`
+}
 type usersMetaResponse struct {
 	Page      int `json:"page"`
 	PageCount int `json:"page_count"`
@@ -58,18 +82,47 @@ type metaResponse struct {
 	Users usersMetaResponse `json:"users"`
 }
 type userResponse struct {
-	Id          string    `json:"id"`
-	StartDate   string    `json:"start_date"`
-	Email       string    `json:"email"`
-	Phone       string    `json:"office_phone"`
-	JobTitle    string    `json:"job_title"`
-	ReportsToId int       `json:"reports_to_id"`
-	Links       userLinks `json:"links"`
+	Id            string    `json:"id"`
+	StartDate     string    `json:"start_date"`
+	Email         string    `json:"email"`
+	FirstName     string    `json:"first_name"`
+	LastName      string    `json:"last_name"`
+	PreferredName string    `json:"preferred_name"`
+	Phone         string    `json:"office_phone"`
+	JobTitle      string    `json:"job_title"`
+	ReportsToId   int       `json:"reports_to_id"`
+	Status        string    `json:"status"`
+	Links         userLinks `json:"links"`
 }
 type usersResponse struct {
 	Users []userResponse `json:"users"`
 	Meta  metaResponse   `json:"meta"`
 }
+type statusLinks struct {
+	UserId       json.Number `json:"user"`
+	StatusTypeId json.Number `json:"status_type"`
+}
+type statusResponse struct {
+	Id       string      `json:"id"`
+	Message  string      `json:"message"`
+	StartsAt time.Time   `json:"starts_at"`
+	EndsAt   time.Time   `json:"ends_at"`
+	Links    statusLinks `json:"links"`
+}
+type statusesMetaResponse struct {
+	Statuses usersMetaResponse `json:"statuses"`
+}
+type statusesResponse struct {
+	Statuses []statusResponse     `json:"statuses"`
+	Meta     statusesMetaResponse `json:"meta"`
+}
+type statusTypeResponse struct {
+	Id   json.Number `json:"id"`
+	Name string      `json:"name"`
+}
+type statusTypesResponse struct {
+	StatusTypes []statusTypeResponse `json:"status_types"`
+}
 
 type Client struct {
 	restClient *resty.Client
@@ -163,6 +216,38 @@ func (c *Client) resolveDepartment(user userResponse, departmentsById map[string
 	return department
 }
 
+func (c *Client) resolveLocation(user userResponse, locationsById map[string]string) string {
+	// We consider the user's location to be the first LocationId in the user's Links (if any) for which
+	// locations/<locationId> returns a single Location with that Id
+
+	if len(user.Links.LocationIds) == 0 {
+		return ""
+	}
+
+	locationId := user.Links.LocationIds[0]
+	location, found := locationsById[locationId]
+	if found {
+		return location
+	}
+
+	response, err := c.restClient.R().
+		Get(fmt.Sprintf("https://app.pingboard.com/api/v2/locations/%s", locationId))
+	locationResult := locationsResponse{}
+	if !c.pingboardResponse(response, err, "location", &locationResult, func() bool {
+		return len(locationResult.Locations) == 1 && locationResult.Locations[0].Id == locationId
+	}) {
+		// remember the failure so that we do not query the same location for every user
+		locationsById[locationId] = ""
+		return ""
+	}
+	c.pluginAPI.LogDebug(fmt.Sprintf("Found location with id %s, name %s",
+		locationId, locationResult.Locations[0].Name))
+	location = locationResult.Locations[0].Name
+	locationsById[locationId] = location
+
+	return location
+}
+
 func (c *Client) FetchCompany() *Company {
 	response, err := c.restClient.R().
 		Get("https://app.pingboard.com/api/v2/companies/my_company")
@@ -183,6 +268,7 @@ func (c *Client) FetchCompany() *Company {
 func (c *Client) FetchUsers() map[string]User {
 	usersById := map[string]User{}
 	departmentsById := map[string]string{}
+	locationsById := map[string]string{}
 
 	pageCount := 0
 	for page := 1; pageCount == 0 || page <= pageCount; page += 1 {
@@ -200,23 +286,29 @@ func (c *Client) FetchUsers() map[string]User {
 		for _, user := range usersResult.Users {
 			department := c.resolveDepartment(user, departmentsById)
 			if department == "" {
-				department = "(unknown department)"
+				department = UnknownDepartment
 			}
+			location := c.resolveLocation(user, locationsById)
 			c.pluginAPI.LogDebug(fmt.Sprintf("Found Pingboard user with "+
-				"email %s, id %s, started %s, phone %s, title %s, manager id %d, department %s",
-				user.Email, user.Id, user.StartDate, user.Phone, user.JobTitle, user.ReportsToId, department))
+				"email %s, id %s, started %s, phone %s, title %s, manager id %d, department %s, location %s",
+				user.Email, user.Id, user.StartDate, user.Phone, user.JobTitle, user.ReportsToId, department, location))
 			reportsToId := ""
 			if user.ReportsToId != 0 {
 				reportsToId = strconv.Itoa(user.ReportsToId)
 			}
 			usersById[user.Id] = User{
-				Id:          user.Id,
-				StartDate:   user.StartDate,
-				Email:       user.Email,
-				Phone:       user.Phone,
-				JobTitle:    user.JobTitle,
-				ReportsToId: reportsToId,
-				Department:  department,
+				Id:            user.Id,
+				StartDate:     user.StartDate,
+				Email:         user.Email,
+				FirstName:     user.FirstName,
+				LastName:      user.LastName,
+				PreferredName: user.PreferredName,
+				Phone:         user.Phone,
+				JobTitle:      user.JobTitle,
+				ReportsToId:   reportsToId,
+				Department:    department,
+				Location:      location,
+				Inactive:      user.Status != "" && user.Status != "active",
 			}
 		}
 	}
@@ -224,3 +316,67 @@ func (c *Client) FetchUsers() map[string]User {
 
 	return usersById
 }
+
+// FetchCurrentStatuses returns the statuses (such as time off) that apply at the given
+// time, by Pingboard user ID.
+func (c *Client) FetchCurrentStatuses(now time.Time) map[string][]Status {
+	response, err := c.restClient.R().
+		Get("https://app.pingboard.com/api/v2/status_types")
+	statusTypesResult := statusTypesResponse{}
+	if !c.pingboardResponse(response, err, "status types", &statusTypesResult, func() bool {
+		return true
+	}) {
+		return nil
+	}
+	statusTypeNamesById := map[string]string{}
+	for _, statusType := range statusTypesResult.StatusTypes {
+		statusTypeNamesById[statusType.Id.String()] = statusType.Name
+	}
+
+	statusesByUserId := map[string][]Status{}
+	count := 0
+	pageCount := 0
+	for page := 1; pageCount == 0 || page <= pageCount; page += 1 {
+		// only statuses that have started and not yet ended
+		response, err := c.restClient.R().
+			SetQueryParams(map[string]string{
+				"page_size": "200",
+				"page":      fmt.Sprintf("%d", page),
+				"starts_at": now.Format(time.RFC3339),
+				"ends_at":   now.Format(time.RFC3339),
+			}).
+			Get("https://app.pingboard.com/api/v2/statuses")
+		statusesResult := statusesResponse{}
+		if !c.pingboardResponse(response, err, "statuses", &statusesResult, func() bool {
+			return statusesResult.Meta.Statuses.Page == page
+		}) {
+			return nil
+		}
+		c.pluginAPI.LogDebug(fmt.Sprintf("Pingboard query: got %d statuses (page %d)", len(statusesResult.Statuses), page))
+		pageCount = statusesResult.Meta.Statuses.PageCount
+		if pageCount == 0 {
+			break
+		}
+		for _, status := range statusesResult.Statuses {
+			// the filter may be coarser than the times themselves
+			if now.Before(status.StartsAt) || !now.Before(status.EndsAt) {
+				continue
+			}
+			userId := status.Links.UserId.String()
+			typeName := statusTypeNamesById[status.Links.StatusTypeId.String()]
+			c.pluginAPI.LogDebug(fmt.Sprintf("Found current Pingboard status for user id %s, type %s, from %s until %s",
+				userId, typeName, status.StartsAt, status.EndsAt))
+			statusesByUserId[userId] = append(statusesByUserId[userId], Status{
+				UserId:   userId,
+				TypeName: typeName,
+				Message:  status.Message,
+				StartsAt: status.StartsAt,
+				EndsAt:   status.EndsAt,
+			})
+			count++
+		}
+	}
+	c.pluginAPI.LogInfo(fmt.Sprintf("Found %d current Pingboard statuses", count))
+
+	return statusesByUserId
+}
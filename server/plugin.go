@@ -2,6 +2,7 @@ package main
 
 import (
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/mattermost/mattermost/server/public/model"
@@ -12,6 +13,9 @@ import (
 type User struct {
 	Id         string `json:"id"`
 	Email      string `json:"email"` // the email address exactly as Pingboard had it
+	FirstName  string `json:"first_name"`
+	LastName   string `json:"last_name"`
+	Nickname   string `json:"nickname"` // the preferred name in Pingboard
 	Url        string `json:"url"`
 	StartYear  int    `json:"start_year"`
 	StartMonth int    `json:"start_month"`
@@ -19,16 +23,44 @@ type User struct {
 	Phone      string `json:"phone"`
 	JobTitle   string `json:"job_title"`
 	Department string `json:"department"`
-	Manager    string `json:"manager"`
+	Location   string `json:"location"`
+	ManagerId  string `json:"manager_id"` // mattermost user ID of the manager
+	Manager    string `json:"manager"`    // manager's username, filled in from ManagerId when read
+
+	hasPingboardManager bool // whether Pingboard lists a manager, even if they could not be matched
 }
 
 type Plugin struct {
 	plugin.MattermostPlugin
-	configurationLock sync.RWMutex
-	refreshLock       sync.RWMutex
-	configuration     *configuration
-	refreshTimer      *time.Timer
-	usersByUsername   map[string]User
+	configurationLock  sync.RWMutex
+	refreshLock        sync.RWMutex
+	refreshTimerLock   sync.Mutex
+	directoryLock      sync.RWMutex
+	configuration      *configuration
+	refreshTimer       *time.Timer
+	refreshRequestedAt time.Time // first of the refresh requests still waiting for the timer
+	refreshDueAt       time.Time // when the timer fires, or zero if it is stopped
+	directory          *directory
+
+	newUsersLock     sync.Mutex
+	queueingNewUsers bool          // while a refresh is running
+	queuedNewUsers   []*model.User // created while a refresh is running
+
+	refreshStatusLock sync.RWMutex
+	refreshStatus     refreshStatus
+	commandRefreshing atomic.Bool // a refresh started by the refresh command has not finished
+
+	profileSyncReportLock sync.RWMutex
+	profileSyncReport     *profileSyncReport
+
+	channelRulesLock       sync.Mutex
+	channelRulesReportLock sync.RWMutex
+	channelRulesReport     *channelRulesReport
+
+	offboardingReportLock sync.RWMutex
+	offboardingReport     *offboardingReport
+
+	rateLimiter rateLimiter
 }
 
 func (p *Plugin) OnConfigurationChange() error {
@@ -45,14 +77,23 @@ func (p *Plugin) OnConfigurationChange() error {
 	return nil
 }
 
-func (p *Plugin) UserHasBeenCreated(c *plugin.Context, _ *model.User) {
+func (p *Plugin) UserHasBeenCreated(c *plugin.Context, user *model.User) {
 	if c.UserAgent == "" {
 		return
 	}
-	p.refreshData()
+	p.noteNewUser(user)
+	if !p.matchNewUser(user) {
+		// the user may be new in Pingboard too, so fetch fresh data
+		p.requestRefresh()
+		return
+	}
+	p.applyChannelRules(p.getDirectory(), []string{user.Id})
 }
 
 func (p *Plugin) OnActivate() error {
-	p.refreshTimer = time.AfterFunc(time.Duration(5)*time.Second, p.refreshData)
+	if err := p.registerCommand(); err != nil {
+		return errors.Wrap(err, "failed to register command")
+	}
+	p.scheduleRefresh(initialRefreshDelay)
 	return nil
 }
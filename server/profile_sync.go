@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/pkg/errors"
+
+	"github.com/imc/mattermost-plugin-pingboard/server/pingboard"
+)
+
+// Profile fields that can be synced from Pingboard, as named in locks and reports
+const (
+	profileFieldPosition     = "position"
+	profileFieldFirstName    = "first_name"
+	profileFieldLastName     = "last_name"
+	profileFieldNickname     = "nickname"
+	profileFieldCustomStatus = "custom_status"
+)
+
+var profileFields = []string{profileFieldPosition, profileFieldFirstName, profileFieldLastName, profileFieldNickname,
+	profileFieldCustomStatus}
+
+const (
+	profileLocksKey         = "profile_locks"
+	profileLocksMaxAttempts = 3
+)
+
+// profileLocksByUserId holds the profile fields each user does not want synced from
+// Pingboard. They are all kept under one key, so that a refresh reads them at once.
+type profileLocksByUserId map[string][]string
+
+func (l profileLocksByUserId) locked(userId string, field string) bool {
+	for _, locked := range l[userId] {
+		if locked == field {
+			return true
+		}
+	}
+	return false
+}
+
+type profileChange struct {
+	UserId   string `json:"user_id"`
+	Username string `json:"username"`
+	Field    string `json:"field"`
+	OldValue string `json:"old_value"`
+	NewValue string `json:"new_value"`
+}
+
+type profileSyncReport struct {
+	Time    time.Time       `json:"time"`
+	DryRun  bool            `json:"dry_run"`
+	Changes []profileChange `json:"changes"`
+	Locked  []profileChange `json:"locked"` // changes not made because the user locked the field
+	Failed  []string        `json:"failed"` // user IDs that could not be read or updated
+}
+
+// profileFieldValue gives access to one synced field of a mattermost user.
+type profileFieldValue struct {
+	field string
+	value *string
+	want  string
+}
+
+// getProfileLocks returns the profile locks of all users, and the data they were read
+// from (nil if no user has locks).
+func (p *Plugin) getProfileLocks() (profileLocksByUserId, []byte, error) {
+	data, appErr := p.API.KVGet(profileLocksKey)
+	if appErr != nil {
+		return nil, nil, appErr
+	}
+	locks := profileLocksByUserId{}
+	if data == nil {
+		return locks, nil, nil
+	}
+	if err := json.Unmarshal(data, &locks); err != nil {
+		return nil, nil, err
+	}
+	return locks, data, nil
+}
+
+// setProfileLocks replaces the user's profile locks, without losing the changes other
+// users make at the same time.
+func (p *Plugin) setProfileLocks(userId string, fields []string) error {
+	for attempt := 0; attempt < profileLocksMaxAttempts; attempt++ {
+		locks, oldData, err := p.getProfileLocks()
+		if err != nil {
+			return err
+		}
+		if len(fields) == 0 {
+			delete(locks, userId)
+		} else {
+			locks[userId] = fields
+		}
+		data, err := json.Marshal(locks)
+		if err != nil {
+			return err
+		}
+		set, appErr := p.API.KVCompareAndSet(profileLocksKey, oldData, data)
+		if appErr != nil {
+			return appErr
+		}
+		if set {
+			return nil
+		}
+	}
+	return errors.New("profile locks kept changing")
+}
+
+// getMattermostUsersById returns all mattermost users, fetched a page at a time.
+func (p *Plugin) getMattermostUsersById() (map[string]*model.User, error) {
+	usersById := map[string]*model.User{}
+	for page := 0; ; page++ {
+		users, appErr := p.API.GetUsers(&model.UserGetOptions{Page: page, PerPage: 500})
+		if appErr != nil {
+			return nil, appErr
+		}
+		if len(users) == 0 {
+			return usersById, nil
+		}
+		for _, user := range users {
+			usersById[user.Id] = user
+		}
+	}
+}
+
+// syncProfile updates the user's mattermost profile from Pingboard according to the
+// configuration, adding what it did (or would do, in a dry run) to the report.
+func (p *Plugin) syncProfile(config *configuration, mmUser *model.User, pbUser pingboard.User, locks profileLocksByUserId,
+	report *profileSyncReport) {
+	userId := mmUser.Id
+
+	var fields []profileFieldValue
+	if config.ProfileSyncPosition {
+		fields = append(fields, profileFieldValue{profileFieldPosition, &mmUser.Position, pbUser.JobTitle})
+	}
+	if config.ProfileSyncNames {
+		fields = append(fields,
+			profileFieldValue{profileFieldFirstName, &mmUser.FirstName, pbUser.FirstName},
+			profileFieldValue{profileFieldLastName, &mmUser.LastName, pbUser.LastName})
+	}
+	if config.ProfileSyncNickname {
+		fields = append(fields, profileFieldValue{profileFieldNickname, &mmUser.Nickname, pbUser.PreferredName})
+	}
+
+	changed := false
+	for _, field := range fields {
+		// never clear a field just because Pingboard has nothing for it
+		if field.want == "" || *field.value == field.want {
+			continue
+		}
+		change := profileChange{
+			UserId:   userId,
+			Username: mmUser.Username,
+			Field:    field.field,
+			OldValue: *field.value,
+			NewValue: field.want,
+		}
+		if locks.locked(userId, field.field) {
+			report.Locked = append(report.Locked, change)
+			continue
+		}
+		report.Changes = append(report.Changes, change)
+		*field.value = field.want
+		changed = true
+	}
+
+	if !changed || report.DryRun {
+		return
+	}
+	if _, appErr := p.API.UpdateUser(mmUser); appErr != nil {
+		p.API.LogError("Profile sync: failed to update mattermost user", "user_id", userId, "error", appErr)
+		report.Failed = append(report.Failed, userId)
+	}
+}
+
+// syncProfiles updates the mattermost profiles of all users in the directory, if
+// enabled in the configuration.
+func (p *Plugin) syncProfiles(dir *directory) {
+	config := p.getConfiguration()
+	if !config.ProfileSyncEnabled {
+		return
+	}
+
+	report := &profileSyncReport{
+		Time:    time.Now(),
+		DryRun:  config.ProfileSyncDryRun,
+		Changes: []profileChange{},
+		Locked:  []profileChange{},
+		Failed:  []string{},
+	}
+	mmUsersById, err := p.getMattermostUsersById()
+	if err != nil {
+		p.API.LogError("Profile sync: failed to get mattermost users", "error", err)
+		return
+	}
+	locks, _, err := p.getProfileLocks()
+	if err != nil {
+		p.API.LogError("Profile sync: failed to get profile locks", "error", err)
+		return
+	}
+	for userId, user := range dir.usersById {
+		mmUser, found := mmUsersById[userId]
+		if !found {
+			p.API.LogError("Profile sync: failed to get mattermost user", "user_id", userId)
+			report.Failed = append(report.Failed, userId)
+			continue
+		}
+		p.syncProfile(config, mmUser, dir.pingboardData.usersById[user.Id], locks, report)
+	}
+
+	for _, change := range report.Changes {
+		p.API.LogDebug(fmt.Sprintf("Profile sync: %s of %s from '%s' to '%s'",
+			change.Field, change.Username, change.OldValue, change.NewValue), "dry_run", report.DryRun)
+	}
+	p.API.LogInfo(fmt.Sprintf("Profile sync: %d changes, %d locked, %d failed",
+		len(report.Changes), len(report.Locked), len(report.Failed)), "dry_run", report.DryRun)
+
+	p.profileSyncReportLock.Lock()
+	defer p.profileSyncReportLock.Unlock()
+	p.profileSyncReport = report
+}
+
+func (p *Plugin) handleGetProfileSyncReport(w http.ResponseWriter, r *http.Request) {
+	p.profileSyncReportLock.RLock()
+	report := p.profileSyncReport
+	p.profileSyncReportLock.RUnlock()
+	if report == nil {
+		p.writeApiError(w, http.StatusNotFound, "not found")
+		return
+	}
+	p.writeApiResponse(w, report)
+}
+
+// profileLocks is the request and response body of the profile locks endpoints.
+type profileLocks struct {
+	LockedFields []string `json:"locked_fields"`
+}
+
+// handleGetProfileLocks returns the profile fields the requesting user does not want
+// synced from Pingboard.
+func (p *Plugin) handleGetProfileLocks(w http.ResponseWriter, r *http.Request) {
+	userId := r.Header.Get("Mattermost-User-ID")
+	locks, _, err := p.getProfileLocks()
+	if err != nil {
+		p.API.LogError("Failed to get profile locks", "user_id", userId, "error", err)
+		p.writeApiError(w, http.StatusInternalServerError, "failed to get profile locks")
+		return
+	}
+	result := profileLocks{LockedFields: []string{}}
+	for _, field := range profileFields {
+		if locks.locked(userId, field) {
+			result.LockedFields = append(result.LockedFields, field)
+		}
+	}
+	p.writeApiResponse(w, result)
+}
+
+// handlePutProfileLocks sets the profile fields the requesting user does not want synced
+// from Pingboard.
+func (p *Plugin) handlePutProfileLocks(w http.ResponseWriter, r *http.Request) {
+	userId := r.Header.Get("Mattermost-User-ID")
+	var request profileLocks
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.LockedFields == nil {
+		p.writeApiError(w, http.StatusBadRequest, "expected locked_fields")
+		return
+	}
+	for _, field := range request.LockedFields {
+		known := false
+		for _, profileField := range profileFields {
+			known = known || field == profileField
+		}
+		if !known {
+			p.writeApiError(w, http.StatusBadRequest, "unknown profile field "+field)
+			return
+		}
+	}
+	if err := p.setProfileLocks(userId, request.LockedFields); err != nil {
+		p.API.LogError("Failed to set profile locks", "user_id", userId, "error", err)
+		p.writeApiError(w, http.StatusInternalServerError, "failed to set profile locks")
+		return
+	}
+	p.API.LogDebug("Set profile locks for " + userId)
+	p.writeApiResponse(w, request)
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/stretchr/testify/mock"
+
+	"github.com/imc/mattermost-plugin-pingboard/server/pingboard"
+)
+
+func TestSyncProfile(t *testing.T) {
+	mmUser := model.User{Id: "alice", Username: "alice", Position: "Engineer", FirstName: "Alice", LastName: "Smith",
+		Nickname: "Al"}
+	pbUser := pingboard.User{JobTitle: "Senior Engineer", FirstName: "Alice", LastName: "Jones", PreferredName: "Ali"}
+	for name, tc := range map[string]struct {
+		config          configuration
+		pbUser          *pingboard.User
+		locks           profileLocksByUserId
+		expectedChanged []string // fields
+		expectedLocked  []string
+		expectedUpdate  *model.User
+	}{
+		"position only": {
+			config:          configuration{ProfileSyncPosition: true},
+			expectedChanged: []string{profileFieldPosition},
+			expectedUpdate: &model.User{Id: "alice", Username: "alice", Position: "Senior Engineer", FirstName: "Alice",
+				LastName: "Smith", Nickname: "Al"},
+		},
+		"names and nickname": {
+			config:          configuration{ProfileSyncNames: true, ProfileSyncNickname: true},
+			expectedChanged: []string{profileFieldLastName, profileFieldNickname},
+			expectedUpdate: &model.User{Id: "alice", Username: "alice", Position: "Engineer", FirstName: "Alice",
+				LastName: "Jones", Nickname: "Ali"},
+		},
+		"locked field": {
+			config:          configuration{ProfileSyncNames: true, ProfileSyncNickname: true},
+			locks:           profileLocksByUserId{"alice": {profileFieldNickname}, "bob": {profileFieldLastName}},
+			expectedChanged: []string{profileFieldLastName},
+			expectedLocked:  []string{profileFieldNickname},
+			expectedUpdate: &model.User{Id: "alice", Username: "alice", Position: "Engineer", FirstName: "Alice",
+				LastName: "Jones", Nickname: "Al"},
+		},
+		"dry run": {
+			config:          configuration{ProfileSyncPosition: true, ProfileSyncDryRun: true},
+			expectedChanged: []string{profileFieldPosition},
+		},
+		"empty pingboard values": {
+			config: configuration{ProfileSyncPosition: true, ProfileSyncNames: true, ProfileSyncNickname: true},
+			pbUser: &pingboard.User{FirstName: "Alice"},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			api := &plugintest.API{}
+			if tc.expectedUpdate != nil {
+				api.On("UpdateUser", tc.expectedUpdate).Return(tc.expectedUpdate, nil).Once()
+			}
+			p := &Plugin{}
+			p.SetAPI(api)
+			if tc.pbUser == nil {
+				tc.pbUser = &pbUser
+			}
+			user := mmUser
+			report := &profileSyncReport{DryRun: tc.config.ProfileSyncDryRun}
+
+			p.syncProfile(&tc.config, &user, *tc.pbUser, tc.locks, report)
+			api.AssertExpectations(t)
+			if tc.expectedUpdate == nil {
+				api.AssertNotCalled(t, "UpdateUser", mock.Anything)
+			}
+			var changed, locked []string
+			for _, change := range report.Changes {
+				changed = append(changed, change.Field)
+			}
+			for _, change := range report.Locked {
+				locked = append(locked, change.Field)
+			}
+			if !reflect.DeepEqual(changed, tc.expectedChanged) || !reflect.DeepEqual(locked, tc.expectedLocked) {
+				t.Logf("expected changes %v and locked %v, got %v and %v", tc.expectedChanged, tc.expectedLocked,
+					changed, locked)
+				t.Fail()
+			}
+			if len(report.Failed) != 0 {
+				t.Logf("expected no failures, got %v", report.Failed)
+				t.Fail()
+			}
+		})
+	}
+}
+
+func TestSyncProfilesReadsLocksOnce(t *testing.T) {
+	locks, _ := json.Marshal(profileLocksByUserId{"bob": {profileFieldPosition}})
+	api := &plugintest.API{}
+	api.On("GetUsers", &model.UserGetOptions{Page: 0, PerPage: 500}).Return([]*model.User{
+		{Id: "alice", Username: "alice"},
+		{Id: "bob", Username: "bob"},
+	}, nil).Once()
+	api.On("GetUsers", &model.UserGetOptions{Page: 1, PerPage: 500}).Return([]*model.User{}, nil).Once()
+	api.On("KVGet", profileLocksKey).Return(locks, nil).Once()
+	api.On("UpdateUser", &model.User{Id: "alice", Username: "alice", Position: "Engineer"}).Return(nil, nil).Once()
+	api.On("LogDebug", mock.Anything, mock.Anything, mock.Anything).Maybe()
+	api.On("LogInfo", mock.Anything, mock.Anything, mock.Anything).Maybe()
+	p := &Plugin{configuration: &configuration{ProfileSyncEnabled: true, ProfileSyncPosition: true}}
+	p.SetAPI(api)
+	dir := newDirectory(map[string]User{"alice": {Id: "pb-alice"}, "bob": {Id: "pb-bob"}})
+	dir.pingboardData = &pingboardData{usersById: map[string]pingboard.User{
+		"pb-alice": {JobTitle: "Engineer"},
+		"pb-bob":   {JobTitle: "Manager"},
+	}}
+
+	p.syncProfiles(dir)
+	api.AssertExpectations(t)
+	report := p.profileSyncReport
+	if len(report.Changes) != 1 || len(report.Locked) != 1 || report.Locked[0].UserId != "bob" {
+		t.Logf("expected alice's position to change and bob's to be locked, got %+v", report)
+		t.Fail()
+	}
+}
+
+func TestPutProfileLocks(t *testing.T) {
+	oldLocks, _ := json.Marshal(profileLocksByUserId{"bob": {profileFieldNickname}})
+	changedLocks, _ := json.Marshal(profileLocksByUserId{"bob": {profileFieldNickname}, "carol": {profileFieldPosition}})
+	api := &plugintest.API{}
+	api.On("KVGet", profileLocksKey).Return(oldLocks, nil).Once()
+	api.On("KVGet", profileLocksKey).Return(changedLocks, nil).Once()
+	newLocks, _ := json.Marshal(profileLocksByUserId{"alice": {profileFieldLastName}, "bob": {profileFieldNickname}})
+	api.On("KVCompareAndSet", profileLocksKey, oldLocks, newLocks).Return(false, nil).Once()
+	newLocks, _ = json.Marshal(profileLocksByUserId{"alice": {profileFieldLastName}, "bob": {profileFieldNickname},
+		"carol": {profileFieldPosition}})
+	api.On("KVCompareAndSet", profileLocksKey, changedLocks, newLocks).Return(true, nil).Once()
+	api.On("LogDebug", mock.Anything).Maybe()
+	p := &Plugin{}
+	p.SetAPI(api)
+
+	// carol changes their locks between reading and writing, so the write is retried
+	r := httptest.NewRequest(http.MethodPut, "/api/v1/user/profile-locks",
+		bytes.NewBufferString(`{"locked_fields": ["last_name"]}`))
+	r.Header.Set("Mattermost-User-ID", "alice")
+	w := httptest.NewRecorder()
+	p.handlePutProfileLocks(w, r)
+	api.AssertExpectations(t)
+	if w.Code != http.StatusOK {
+		t.Logf("expected status 200, got %d: %s", w.Code, w.Body)
+		t.Fail()
+	}
+
+	r = httptest.NewRequest(http.MethodPut, "/api/v1/user/profile-locks",
+		bytes.NewBufferString(`{"locked_fields": ["shoe_size"]}`))
+	r.Header.Set("Mattermost-User-ID", "alice")
+	w = httptest.NewRecorder()
+	p.handlePutProfileLocks(w, r)
+	if w.Code != http.StatusBadRequest {
+		t.Logf("expected status 400 for an unknown field, got %d", w.Code)
+		t.Fail()
+	}
+}
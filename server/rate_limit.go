@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+const (
+	defaultRateLimitPerMinute = 120
+	defaultRateLimitBurst     = 30
+)
+
+// tokenBucket holds the requests a user may still make to an endpoint right away; it
+// fills up again at the endpoint's rate, up to the burst size.
+type tokenBucket struct {
+	tokens    float64
+	updatedAt time.Time
+	fullAt    time.Time // from when it is the same as a new bucket
+}
+
+// rateLimiter limits how fast each user can call each endpoint, counting the requests it
+// allowed and refused.
+type rateLimiter struct {
+	lock     sync.Mutex
+	buckets  map[string]*tokenBucket // by user ID and route path
+	allowed  map[string]int64        // by route path
+	limited  map[string]int64        // by route path
+	prunedAt time.Time
+}
+
+type rateLimit struct {
+	perMinute int
+	burst     int
+}
+
+// take takes a token from the bucket for the user and route, if there is one. If not,
+// returns how long until there will be.
+func (l *rateLimiter) take(userId string, routePath string, limit rateLimit, now time.Time) (bool, time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.buckets == nil {
+		l.buckets = map[string]*tokenBucket{}
+		l.allowed = map[string]int64{}
+		l.limited = map[string]int64{}
+	}
+	perSecond := float64(limit.perMinute) / 60
+	burst := float64(limit.burst)
+
+	// forget buckets that have filled up again
+	if now.Sub(l.prunedAt) > time.Minute {
+		for key, bucket := range l.buckets {
+			if !now.Before(bucket.fullAt) {
+				delete(l.buckets, key)
+			}
+		}
+		l.prunedAt = now
+	}
+
+	key := userId + " " + routePath
+	bucket, found := l.buckets[key]
+	if !found {
+		bucket = &tokenBucket{tokens: burst, updatedAt: now}
+		l.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(burst, bucket.tokens+now.Sub(bucket.updatedAt).Seconds()*perSecond)
+	bucket.updatedAt = now
+
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / perSecond * float64(time.Second))
+	}
+	bucket.tokens--
+	bucket.fullAt = now.Add(time.Duration((burst - bucket.tokens) / perSecond * float64(time.Second)))
+	return true, 0
+}
+
+// count counts a request to the route as allowed or refused.
+func (l *rateLimiter) count(routePath string, allowed bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if allowed {
+		l.allowed[routePath]++
+	} else {
+		l.limited[routePath]++
+	}
+}
+
+type rateLimitCounts struct {
+	Path    string `json:"path"`
+	Allowed int64  `json:"allowed"`
+	Limited int64  `json:"limited"`
+}
+
+// counts returns the requests allowed and refused since the plugin started, by route
+// path, and how many users are currently being limited or have recently made requests.
+func (l *rateLimiter) counts() ([]rateLimitCounts, int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	paths := map[string]bool{}
+	for path := range l.allowed {
+		paths[path] = true
+	}
+	for path := range l.limited {
+		paths[path] = true
+	}
+	counts := []rateLimitCounts{}
+	for path := range paths {
+		counts = append(counts, rateLimitCounts{Path: path, Allowed: l.allowed[path], Limited: l.limited[path]})
+	}
+	sort.Slice(counts, func(i, j int) bool { return counts[i].Path < counts[j].Path })
+	return counts, len(l.buckets)
+}
+
+// rateLimitFor returns the limit for the route path: the configured default, or an
+// override given as lines or comma-separated entries such as "/search = 30" (requests per
+// minute). The burst is never more than the rate per minute.
+func (c *configuration) rateLimitFor(routePath string) rateLimit {
+	limit := rateLimit{perMinute: c.RateLimitPerMinute, burst: c.RateLimitBurst}
+	if limit.perMinute <= 0 {
+		limit.perMinute = defaultRateLimitPerMinute
+	}
+	if limit.burst <= 0 {
+		limit.burst = defaultRateLimitBurst
+	}
+	for _, override := range strings.FieldsFunc(c.RateLimitOverrides, func(r rune) bool { return r == ',' || r == '\n' }) {
+		path, value, found := strings.Cut(override, "=")
+		if !found || strings.TrimSpace(path) != routePath {
+			continue
+		}
+		if perMinute, err := strconv.Atoi(strings.TrimSpace(value)); err == nil && perMinute > 0 {
+			limit.perMinute = perMinute
+		}
+	}
+	limit.burst = min(limit.burst, limit.perMinute)
+	return limit
+}
+
+// checkRateLimit takes a request from the user's allowance for the route, if rate limits
+// are enabled. System admins are not limited. If the user has run out, a 429 response has
+// already been written.
+func (p *Plugin) checkRateLimit(w http.ResponseWriter, r *http.Request, rt route) bool {
+	config := p.getConfiguration()
+	if !config.RateLimitEnabled || rt.auth != authUser {
+		return true
+	}
+	userId := r.Header.Get("Mattermost-User-ID")
+	allowed, retryAfter := p.rateLimiter.take(userId, rt.path, config.rateLimitFor(rt.path), time.Now())
+	// admins are only checked for once they would be limited, to save looking them up
+	allowed = allowed || p.API.HasPermissionTo(userId, model.PermissionManageSystem)
+	p.rateLimiter.count(rt.path, allowed)
+	if allowed {
+		return true
+	}
+
+	seconds := int(math.Ceil(retryAfter.Seconds()))
+	p.API.LogDebug(fmt.Sprintf("Returning too many requests for %s to %s (retry after %ds)", userId, rt.path, seconds))
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	p.writeApiError(w, http.StatusTooManyRequests, "too many requests")
+	return false
+}
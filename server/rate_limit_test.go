@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := &rateLimiter{}
+	limit := rateLimit{perMinute: 60, burst: 2}
+	start := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	for i, step := range []struct {
+		after      time.Duration
+		userId     string
+		expected   bool
+		retryAfter time.Duration
+	}{
+		{after: 0, userId: "alice", expected: true},
+		{after: 0, userId: "alice", expected: true},
+		{after: 0, userId: "alice", expected: false, retryAfter: time.Second},
+		{after: 0, userId: "bob", expected: true},
+		{after: 500 * time.Millisecond, userId: "alice", expected: false, retryAfter: 500 * time.Millisecond},
+		{after: time.Second, userId: "alice", expected: true},
+		{after: time.Second, userId: "alice", expected: false, retryAfter: time.Second},
+		{after: time.Hour, userId: "alice", expected: true},
+		{after: time.Hour, userId: "alice", expected: true},
+	} {
+		allowed, retryAfter := limiter.take(step.userId, "/search", limit, start.Add(step.after))
+		if allowed != step.expected || retryAfter != step.retryAfter {
+			t.Logf("step %d: expected %v (retry after %v), got %v (retry after %v)",
+				i, step.expected, step.retryAfter, allowed, retryAfter)
+			t.Fail()
+		}
+	}
+}
+
+func TestRateLimitFor(t *testing.T) {
+	config := &configuration{RateLimitPerMinute: 100, RateLimitBurst: 20, RateLimitOverrides: "/search = 10\n/users=abc, /export=1"}
+
+	for path, expected := range map[string]rateLimit{
+		"/user":   {perMinute: 100, burst: 20},
+		"/search": {perMinute: 10, burst: 10},
+		"/users":  {perMinute: 100, burst: 20},
+		"/export": {perMinute: 1, burst: 1},
+	} {
+		if limit := config.rateLimitFor(path); limit != expected {
+			t.Logf("%s: expected %+v, got %+v", path, expected, limit)
+			t.Fail()
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"regexp"
@@ -13,9 +14,17 @@ import (
 	"github.com/imc/mattermost-plugin-pingboard/server/pingboard"
 )
 
+const (
+	initialRefreshDelay = 5 * time.Second
+	refreshInterval     = 6 * time.Hour
+	refreshDebounce     = time.Minute
+	refreshMaxDelay     = 10 * time.Minute
+)
+
 type pingboardData struct {
-	company   *pingboard.Company
-	usersById map[string]pingboard.User
+	company          *pingboard.Company
+	usersById        map[string]pingboard.User
+	statusesByUserId map[string][]pingboard.Status // nil unless custom statuses are enabled and were fetched
 }
 
 var dateExpr = regexp.MustCompile(`([0-9]{4})-([0-9]{2})-([0-9]{2})`)
@@ -31,8 +40,8 @@ func normalisedEmail(email string) string {
 	return emailRetainedChars.ReplaceAllString(strings.ToLower(email), "")
 }
 
-func (p *Plugin) getMattermostUsernamesByNormalisedEmail() map[string]string {
-	mmUsernamesByNormalisedEmail := map[string]string{}
+func (p *Plugin) getMattermostUserIdsByNormalisedEmail() map[string]string {
+	mmUserIdsByNormalisedEmail := map[string]string{}
 
 	page := 0
 	for {
@@ -50,21 +59,53 @@ func (p *Plugin) getMattermostUsernamesByNormalisedEmail() map[string]string {
 		page += 1
 		for _, mattermostUser := range mmUsers {
 			mmEmail := normalisedEmail(mattermostUser.Email)
-			if _, exists := mmUsernamesByNormalisedEmail[mmEmail]; exists {
+			if _, exists := mmUserIdsByNormalisedEmail[mmEmail]; exists {
 				p.API.LogError(fmt.Sprintf("Found multiple mattermost users with (normalised) email %s", mmEmail))
 				return nil
 			}
-			p.API.LogDebug(fmt.Sprintf("Found mattermost user %s with normalised email %s",
-				mattermostUser.Username, mmEmail))
-			mmUsernamesByNormalisedEmail[mmEmail] = mattermostUser.Username
+			p.API.LogDebug(fmt.Sprintf("Found mattermost user %s (%s) with normalised email %s",
+				mattermostUser.Username, mattermostUser.Id, mmEmail))
+			mmUserIdsByNormalisedEmail[mmEmail] = mattermostUser.Id
 		}
 	}
-	p.API.LogInfo(fmt.Sprintf("Found %d mattermost users", len(mmUsernamesByNormalisedEmail)))
+	p.API.LogInfo(fmt.Sprintf("Found %d mattermost users", len(mmUserIdsByNormalisedEmail)))
+
+	return mmUserIdsByNormalisedEmail
+}
 
-	return mmUsernamesByNormalisedEmail
+// getTeamIdsByUserId returns the IDs of the mattermost teams each of the given users is a
+// member of, reading the members of each team a page at a time. Returns nil on failure.
+func (p *Plugin) getTeamIdsByUserId(usersById map[string]User) map[string]map[string]bool {
+	teams, appErr := p.API.GetTeams()
+	if appErr != nil {
+		p.API.LogWarn("Failed to get mattermost teams", "error", appErr)
+		return nil
+	}
+	teamIdsByUserId := map[string]map[string]bool{}
+	for userId := range usersById {
+		teamIdsByUserId[userId] = map[string]bool{}
+	}
+	for _, team := range teams {
+		for page := 0; ; page++ {
+			members, appErr := p.API.GetTeamMembers(team.Id, page, 200)
+			if appErr != nil {
+				p.API.LogWarn("Failed to get mattermost team members", "team_id", team.Id, "error", appErr)
+				return nil
+			}
+			if len(members) == 0 {
+				break
+			}
+			for _, member := range members {
+				if teamIds, found := teamIdsByUserId[member.UserId]; found && member.DeleteAt == 0 {
+					teamIds[team.Id] = true
+				}
+			}
+		}
+	}
+	return teamIdsByUserId
 }
 
-func (p *Plugin) fetchPingboardData(apiID string, apiSecret string) *pingboardData {
+func (p *Plugin) fetchPingboardData(apiID string, apiSecret string, fetchStatuses bool) *pingboardData {
 	pbClient := pingboard.NewClient(p.API, apiID, apiSecret)
 
 	if pbClient == nil {
@@ -81,19 +122,80 @@ func (p *Plugin) fetchPingboardData(apiID string, apiSecret string) *pingboardDa
 		return nil
 	}
 
+	// statuses are optional: without them, custom statuses are left as they are
+	var pbStatusesByUserId map[string][]pingboard.Status
+	if fetchStatuses {
+		pbStatusesByUserId = pbClient.FetchCurrentStatuses(time.Now())
+	}
+
 	return &pingboardData{
-		company:   company,
-		usersById: pbUsersById,
+		company:          company,
+		usersById:        pbUsersById,
+		statusesByUserId: pbStatusesByUserId,
 	}
 }
 
-func (p *Plugin) resolveUsers(pbData *pingboardData, mmUsernamesByNormalisedEmail map[string]string) map[string]User {
-	usersByUsername := map[string]User{}
+// resolveUser assembles the data for a mattermost user from the Pingboard user they matched.
+func (p *Plugin) resolveUser(pbData *pingboardData, pbUser pingboard.User, mmUserId string,
+	mmUserIdsByNormalisedEmail map[string]string) User {
+	p.API.LogDebug(fmt.Sprintf("Recording data for user %s matched by normalised email %s",
+		mmUserId, normalisedEmail(pbUser.Email)))
+
+	startYear := 0
+	startMonth := 0
+	startDay := 0
+	dateParts := dateExpr.FindStringSubmatch(pbUser.StartDate)
+	if dateParts != nil {
+		startYear, _ = strconv.Atoi(dateParts[1])
+		startMonth, _ = strconv.Atoi(dateParts[2])
+		startDay, _ = strconv.Atoi(dateParts[3])
+	}
+
+	mmManagerId := ""
+	managerId := pbUser.ReportsToId
+	if managerId != "" {
+		if managerUser, found := pbData.usersById[managerId]; found {
+			managerEmail := normalisedEmail(managerUser.Email)
+			if mmManagerId, found = mmUserIdsByNormalisedEmail[managerEmail]; found {
+				p.API.LogDebug(fmt.Sprintf("User %s matched to manager %s by normalised email %s",
+					mmUserId, mmManagerId, managerEmail))
+			} else {
+				p.API.LogDebug(fmt.Sprintf("User %s has manager with unmatched normalised email %s",
+					mmUserId, managerEmail))
+			}
+		} else {
+			p.API.LogDebug(fmt.Sprintf("User %s has manager with unknown Pingboard ID %s",
+				mmUserId, managerId))
+		}
+	}
+
+	return User{
+		Id:         pbUser.Id,
+		Email:      pbUser.Email,
+		FirstName:  pbUser.FirstName,
+		LastName:   pbUser.LastName,
+		Nickname:   pbUser.PreferredName,
+		Url:        fmt.Sprintf("https://%s.pingboard.com/users/%s", pbData.company.Domain, pbUser.Id),
+		StartYear:  startYear,
+		StartMonth: startMonth,
+		StartDay:   startDay,
+		Phone:      pbUser.Phone,
+		JobTitle:   pbUser.JobTitle,
+		Department: pbUser.Department,
+		Location:   pbUser.Location,
+		ManagerId:  mmManagerId,
+
+		hasPingboardManager: managerId != "",
+	}
+}
+
+func (p *Plugin) resolveUsers(pbData *pingboardData, mmUserIdsByNormalisedEmail map[string]string) map[string]User {
+	usersById := map[string]User{}
 	pbNormalisedEmails := map[string]bool{}
 	for _, pbUser := range pbData.usersById {
 		pbUserNormalisedEmail := normalisedEmail(pbUser.Email)
 
-		mmUsername, found := mmUsernamesByNormalisedEmail[pbUserNormalisedEmail]
+		mmUserId, found := mmUserIdsByNormalisedEmail[pbUserNormalisedEmail]
 		if !found {
 			p.API.LogDebug(fmt.Sprintf("Ignoring Pingboard user with normalised email %s (no matching mattermost user)",
 				pbUserNormalisedEmail))
@@ -107,64 +209,198 @@ func (p *Plugin) resolveUsers(pbData *pingboardData, mmUsernamesByNormalisedEmai
 		}
 		pbNormalisedEmails[pbUserNormalisedEmail] = true
 
-		p.API.LogDebug(fmt.Sprintf("Recording data for user %s matched by normalised email %s",
-			mmUsername, pbUserNormalisedEmail))
-
-		startYear := 0
-		startMonth := 0
-		startDay := 0
-		dateParts := dateExpr.FindStringSubmatch(pbUser.StartDate)
-		if dateParts != nil {
-			startYear, _ = strconv.Atoi(dateParts[1])
-			startMonth, _ = strconv.Atoi(dateParts[2])
-			startDay, _ = strconv.Atoi(dateParts[3])
-		}
+		usersById[mmUserId] = p.resolveUser(pbData, pbUser, mmUserId, mmUserIdsByNormalisedEmail)
+	}
 
-		manager := ""
-		managerId := pbUser.ReportsToId
-		if managerId != "" {
-			if managerUser, found := pbData.usersById[managerId]; found {
-				managerEmail := normalisedEmail(managerUser.Email)
-				if manager, found = mmUsernamesByNormalisedEmail[managerEmail]; found {
-					p.API.LogDebug(fmt.Sprintf("User %s matched to manager %s by normalised email %s",
-						mmUsername, manager, managerEmail))
-				} else {
-					p.API.LogDebug(fmt.Sprintf("User %s has manager with unmatched normalised email %s",
-						mmUsername, managerEmail))
-				}
-			} else {
-				p.API.LogDebug(fmt.Sprintf("User %s has manager with unknown Pingboard ID %s",
-					mmUsername, managerId))
+	return usersById
+}
+
+// scheduleRefresh sets the refresh timer to fire after the given delay, replacing any
+// refresh that was already scheduled.
+func (p *Plugin) scheduleRefresh(delay time.Duration) {
+	p.refreshTimerLock.Lock()
+	defer p.refreshTimerLock.Unlock()
+
+	p.refreshRequestedAt = time.Time{}
+	p.refreshDueAt = time.Now().Add(delay)
+	if p.refreshTimer == nil {
+		p.refreshTimer = time.AfterFunc(delay, p.refreshData)
+		return
+	}
+	p.refreshTimer.Reset(delay)
+}
+
+// requestRefresh asks for a full refresh soon. Requests arriving in quick succession are
+// coalesced: the refresh runs once no request has arrived for refreshDebounce, but no
+// later than refreshMaxDelay after the first of them.
+func (p *Plugin) requestRefresh() {
+	p.refreshTimerLock.Lock()
+	defer p.refreshTimerLock.Unlock()
+
+	if p.refreshTimer == nil {
+		return
+	}
+	now := time.Now()
+	if p.refreshRequestedAt.IsZero() {
+		p.refreshRequestedAt = now
+	}
+	delay := refreshDelay(p.refreshRequestedAt, now)
+	p.refreshDueAt = now.Add(delay)
+	p.refreshTimer.Reset(delay)
+}
+
+// refreshDelay returns how long to wait before a refresh requested now, given when the
+// first of the requests still waiting was made.
+func refreshDelay(firstRequestedAt time.Time, now time.Time) time.Duration {
+	delay := refreshDebounce
+	if latest := firstRequestedAt.Add(refreshMaxDelay); now.Add(delay).After(latest) {
+		delay = latest.Sub(now)
+	}
+	return delay
+}
+
+// stopRefreshTimer cancels any scheduled refresh. Returns false if the plugin has not
+// been activated yet.
+func (p *Plugin) stopRefreshTimer() bool {
+	p.refreshTimerLock.Lock()
+	defer p.refreshTimerLock.Unlock()
+
+	if p.refreshTimer == nil {
+		return false
+	}
+	p.refreshTimer.Stop()
+	p.refreshRequestedAt = time.Time{}
+	p.refreshDueAt = time.Time{}
+	return true
+}
+
+// queueNewUsers starts holding on to the users created from now on, until
+// takeQueuedNewUsers. A refresh replaces the directory with one built from the users that
+// existed when it started, dropping any users matched in the meantime, so it matches them
+// again afterwards.
+func (p *Plugin) queueNewUsers() {
+	p.newUsersLock.Lock()
+	defer p.newUsersLock.Unlock()
+
+	p.queueingNewUsers = true
+	p.queuedNewUsers = nil
+}
+
+// noteNewUser adds a newly created user to the queue, if a refresh is running.
+func (p *Plugin) noteNewUser(mmUser *model.User) {
+	p.newUsersLock.Lock()
+	defer p.newUsersLock.Unlock()
+
+	if p.queueingNewUsers {
+		p.queuedNewUsers = append(p.queuedNewUsers, mmUser)
+	}
+}
+
+// takeQueuedNewUsers stops queueing new users, and returns those queued.
+func (p *Plugin) takeQueuedNewUsers() []*model.User {
+	p.newUsersLock.Lock()
+	defer p.newUsersLock.Unlock()
+
+	queued := p.queuedNewUsers
+	p.queueingNewUsers = false
+	p.queuedNewUsers = nil
+	return queued
+}
+
+// matchNewUser adds a newly created mattermost user to the directory by matching them
+// against the Pingboard data of the last refresh, without querying either system again.
+// Returns false if there is no data yet, or no Pingboard user matches.
+func (p *Plugin) matchNewUser(mmUser *model.User) bool {
+	return p.matchNewUsers([]*model.User{mmUser})[0]
+}
+
+// matchNewUsers is matchNewUser for several users at once, rebuilding the directory only
+// once. Returns whether each user matched.
+func (p *Plugin) matchNewUsers(mmUsers []*model.User) []bool {
+	p.directoryLock.Lock()
+	defer p.directoryLock.Unlock()
+
+	matched := make([]bool, len(mmUsers))
+	dir := p.directory
+	if dir == nil || dir.pingboardData == nil {
+		return matched
+	}
+
+	pbUsersByEmail := map[string][]pingboard.User{}
+	for _, pbUser := range dir.pingboardData.usersById {
+		email := normalisedEmail(pbUser.Email)
+		pbUsersByEmail[email] = append(pbUsersByEmail[email], pbUser)
+	}
+	mmUserIdsByNormalisedEmail := map[string]string{}
+	for email, userId := range dir.mmUserIdsByNormalisedEmail {
+		mmUserIdsByNormalisedEmail[email] = userId
+	}
+	newPbUsersById := map[string]pingboard.User{} // by mattermost user ID
+	newMmUserIdsByPbId := map[string]string{}
+	for i, mmUser := range mmUsers {
+		mmEmail := normalisedEmail(mmUser.Email)
+		if existingId, exists := mmUserIdsByNormalisedEmail[mmEmail]; exists {
+			if existingId != mmUser.Id {
+				p.API.LogError(fmt.Sprintf("Found multiple mattermost users with (normalised) email %s", mmEmail))
 			}
+			matched[i] = true
+			continue
 		}
-
-		newUser := User{
-			Id:         pbUser.Id,
-			Email:      pbUser.Email,
-			Url:        fmt.Sprintf("https://%s.pingboard.com/users/%s", pbData.company.Domain, pbUser.Id),
-			StartYear:  startYear,
-			StartMonth: startMonth,
-			StartDay:   startDay,
-			Phone:      pbUser.Phone,
-			JobTitle:   pbUser.JobTitle,
-			Department: pbUser.Department,
-			Manager:    manager,
+		candidates := pbUsersByEmail[mmEmail]
+		if len(candidates) == 0 {
+			p.API.LogDebug(fmt.Sprintf("New mattermost user %s with normalised email %s has no Pingboard user",
+				mmUser.Id, mmEmail))
+			continue
+		}
+		matched[i] = true
+		if len(candidates) > 1 {
+			p.API.LogError(fmt.Sprintf("Found multiple Pingboard users with (normalised) email %s", mmEmail))
+			continue
 		}
+		mmUserIdsByNormalisedEmail[mmEmail] = mmUser.Id
+		newPbUsersById[mmUser.Id] = candidates[0]
+		newMmUserIdsByPbId[candidates[0].Id] = mmUser.Id
+	}
+	if len(newPbUsersById) == 0 {
+		return matched
+	}
 
-		usersByUsername[mmUsername] = newUser
+	usersById := map[string]User{}
+	for userId, user := range dir.usersById {
+		// users reporting to the new users can now be linked to them
+		if managerId, found := newMmUserIdsByPbId[dir.pingboardData.usersById[user.Id].ReportsToId]; found && user.ManagerId == "" {
+			user.ManagerId = managerId
+		}
+		usersById[userId] = user
+	}
+	for mmUserId, pbUser := range newPbUsersById {
+		usersById[mmUserId] = p.resolveUser(dir.pingboardData, pbUser, mmUserId, mmUserIdsByNormalisedEmail)
+		p.API.LogInfo(fmt.Sprintf("Matched new mattermost user %s to Pingboard user %s", mmUserId, pbUser.Id))
 	}
 
-	return usersByUsername
+	p.directory = newDirectory(usersById)
+	p.directory.pingboardData = dir.pingboardData
+	p.directory.mmUserIdsByNormalisedEmail = mmUserIdsByNormalisedEmail
+	p.directory.teamIdsByUserId = dir.teamIdsByUserId // the new users' teams are looked up as needed
+	return matched
 }
 
 func (p *Plugin) refreshData() {
+	p.refresh(func(string) {})
+}
+
+// refresh fetches fresh data from Mattermost and Pingboard, replaces the directory with it,
+// and applies it. Progress is reported as each stage starts. The outcome is recorded in
+// the refresh status.
+func (p *Plugin) refresh(progress func(string)) (*refreshSummary, error) {
 	p.refreshLock.Lock()
 	defer p.refreshLock.Unlock()
 
-	if p.refreshTimer == nil {
-		return
+	if !p.stopRefreshTimer() {
+		// the configuration is loaded before activation, which schedules the first refresh,
+		// so this is expected and not recorded as a failure
+		return nil, errors.New("the plugin has not been activated yet")
 	}
-	p.refreshTimer.Stop()
 
 	config := p.getConfiguration()
 	clientId := config.PingboardApiId
@@ -176,31 +412,66 @@ func (p *Plugin) refreshData() {
 	if clientId == "" || clientSecret == "" {
 		p.API.LogInfo("No Pingboard client configuration")
 		// do not schedule more attempts (config change will already trigger a refresh)
-		return
+		p.refreshNotConfigured()
+		return nil, errors.New("no Pingboard client configuration")
 	}
 
 	// always schedule a later attempt even if we fail with errors below
-	p.refreshTimer = time.AfterFunc(time.Duration(6)*time.Hour, p.refreshData)
+	p.scheduleRefresh(refreshInterval)
 
 	p.API.LogInfo("Refreshing data...")
+	startedAt := time.Now()
+	p.refreshStarted(startedAt)
+	summary, err := p.refreshDirectory(config, clientId, clientSecret, progress)
+	p.refreshFinished(startedAt, summary, err)
+	return summary, err
+}
+
+func (p *Plugin) refreshDirectory(config *configuration, clientId string, clientSecret string,
+	progress func(string)) (*refreshSummary, error) {
+	p.queueNewUsers()
+	defer p.takeQueuedNewUsers()
 
 	// Index all mattermost users by normalised email address
-	mmUsernamesByNormalisedEmail := p.getMattermostUsernamesByNormalisedEmail()
-	if mmUsernamesByNormalisedEmail == nil {
-		return
+	progress("Fetching Mattermost users...")
+	mmUserIdsByNormalisedEmail := p.getMattermostUserIdsByNormalisedEmail()
+	if mmUserIdsByNormalisedEmail == nil {
+		return nil, errors.New("failed to index Mattermost users by email (see the server log)")
 	}
 
 	// Get data from pingboard
-	pbData := p.fetchPingboardData(clientId, clientSecret)
+	progress("Fetching Pingboard data...")
+	pbData := p.fetchPingboardData(clientId, clientSecret, config.CustomStatusEnabled)
 	if pbData == nil {
-		return
+		return nil, errors.New("failed to fetch Pingboard data (see the server log)")
 	}
 
-	// Assemble final info by usernames
-	usersByUsername := p.resolveUsers(pbData, mmUsernamesByNormalisedEmail)
-	if usersByUsername == nil {
-		return
+	// Assemble final info by mattermost user ID
+	usersById := p.resolveUsers(pbData, mmUserIdsByNormalisedEmail)
+	if usersById == nil {
+		return nil, errors.New("failed to match Pingboard users")
+	}
+
+	dir := newDirectory(usersById)
+	dir.pingboardData = pbData
+	dir.mmUserIdsByNormalisedEmail = mmUserIdsByNormalisedEmail
+	dir.teamIdsByUserId = p.getTeamIdsByUserId(usersById)
+	p.setDirectory(dir)
+	if queued := p.takeQueuedNewUsers(); len(queued) > 0 {
+		p.matchNewUsers(queued)
+		dir = p.getDirectory()
 	}
 
-	p.usersByUsername = usersByUsername
+	progress(fmt.Sprintf("Matched %d users. Syncing profiles, channels and statuses...", len(usersById)))
+	p.syncProfiles(dir)
+	p.applyChannelRules(dir, nil)
+	p.detectOffboarding(dir)
+	p.syncCustomStatuses(dir)
+
+	return &refreshSummary{
+		MattermostUsers: len(mmUserIdsByNormalisedEmail),
+		PingboardUsers:  len(pbData.usersById),
+		MatchedUsers:    len(usersById),
+		Departments:     len(dir.departments),
+	}, nil
 }
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"time"
+)
+
+// How many of the most recent refresh failures are kept
+const refreshMaxRecentErrors = 10
+
+type refreshError struct {
+	Time    time.Time `json:"time"`
+	Message string    `json:"message"`
+}
+
+// refreshSummary counts what a successful refresh loaded.
+type refreshSummary struct {
+	MattermostUsers int `json:"mattermost_users"`
+	PingboardUsers  int `json:"pingboard_users"`
+	MatchedUsers    int `json:"matched_users"`
+	Departments     int `json:"departments"`
+}
+
+// refreshStatus records the outcomes of refreshes since the plugin started.
+type refreshStatus struct {
+	NotConfigured   bool            `json:"not_configured"` // the last refresh was skipped for want of credentials
+	Running         bool            `json:"running"`
+	LastStartedAt   time.Time       `json:"last_started_at"`
+	LastSucceededAt time.Time       `json:"last_succeeded_at"`
+	LastDuration    string          `json:"last_duration,omitempty"` // of the last successful refresh
+	LastSummary     *refreshSummary `json:"last_summary,omitempty"`
+	RecentErrors    []refreshError  `json:"recent_errors"` // most recent last
+}
+
+func (p *Plugin) getRefreshStatus() refreshStatus {
+	p.refreshStatusLock.RLock()
+	defer p.refreshStatusLock.RUnlock()
+
+	status := p.refreshStatus
+	status.RecentErrors = append([]refreshError{}, p.refreshStatus.RecentErrors...)
+	return status
+}
+
+func (p *Plugin) refreshStarted(now time.Time) {
+	p.refreshStatusLock.Lock()
+	defer p.refreshStatusLock.Unlock()
+
+	p.refreshStatus.NotConfigured = false
+	p.refreshStatus.Running = true
+	p.refreshStatus.LastStartedAt = now
+}
+
+// refreshNotConfigured records that a refresh was skipped because there are no Pingboard
+// credentials. This is not an error: the plugin is simply not set up yet.
+func (p *Plugin) refreshNotConfigured() {
+	p.refreshStatusLock.Lock()
+	defer p.refreshStatusLock.Unlock()
+
+	p.refreshStatus.NotConfigured = true
+}
+
+// refreshFinished records the outcome of the refresh that started at the given time.
+func (p *Plugin) refreshFinished(startedAt time.Time, summary *refreshSummary, err error) {
+	p.refreshStatusLock.Lock()
+	defer p.refreshStatusLock.Unlock()
+
+	now := time.Now()
+	p.refreshStatus.Running = false
+	if err != nil {
+		p.refreshStatus.RecentErrors = append(p.refreshStatus.RecentErrors, refreshError{Time: now, Message: err.Error()})
+		if excess := len(p.refreshStatus.RecentErrors) - refreshMaxRecentErrors; excess > 0 {
+			p.refreshStatus.RecentErrors = p.refreshStatus.RecentErrors[excess:]
+		}
+		return
+	}
+	p.refreshStatus.LastSucceededAt = now
+	p.refreshStatus.LastDuration = now.Sub(startedAt).Round(time.Millisecond).String()
+	p.refreshStatus.LastSummary = summary
+}
+
+// nextRefreshAt returns when the refresh timer is next due, or the zero time if no refresh
+// is scheduled.
+func (p *Plugin) nextRefreshAt() time.Time {
+	p.refreshTimerLock.Lock()
+	defer p.refreshTimerLock.Unlock()
+
+	return p.refreshDueAt
+}
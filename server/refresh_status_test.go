@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRefreshFinished(t *testing.T) {
+	p := &Plugin{}
+	startedAt := time.Now()
+	for i := 0; i < refreshMaxRecentErrors+2; i++ {
+		p.refreshStarted(startedAt)
+		p.refreshFinished(startedAt, nil, fmt.Errorf("failure %d", i))
+	}
+	status := p.getRefreshStatus()
+	if status.Running || status.LastSummary != nil || !status.LastSucceededAt.IsZero() {
+		t.Logf("Expected no successful refresh, got %+v", status)
+		t.Fail()
+	}
+	if len(status.RecentErrors) != refreshMaxRecentErrors || status.RecentErrors[0].Message != "failure 2" {
+		t.Logf("Expected the most recent %d errors, got %+v", refreshMaxRecentErrors, status.RecentErrors)
+		t.Fail()
+	}
+
+	p.refreshStarted(startedAt)
+	p.refreshFinished(startedAt, &refreshSummary{MatchedUsers: 3}, nil)
+	status = p.getRefreshStatus()
+	if status.Running || status.LastSummary == nil || status.LastSummary.MatchedUsers != 3 || status.LastDuration == "" {
+		t.Logf("Expected a successful refresh, got %+v", status)
+		t.Fail()
+	}
+	if len(status.RecentErrors) != refreshMaxRecentErrors {
+		t.Logf("Expected the errors to be kept, got %+v", status.RecentErrors)
+		t.Fail()
+	}
+}
+
+func TestRefreshBeforeStarting(t *testing.T) {
+	t.Setenv("MM_PLUGIN_PINGBOARD_CLIENT_SECRET", "")
+
+	p := newLogOnlyPlugin()
+	p.configuration = &configuration{}
+	if _, err := p.refresh(func(string) {}); err == nil {
+		t.Log("expected refreshing before activation to fail")
+		t.Fail()
+	}
+	if status := p.getRefreshStatus(); len(status.RecentErrors) != 0 || status.NotConfigured {
+		t.Logf("expected refreshing before activation not to be recorded, got %+v", status)
+		t.Fail()
+	}
+
+	// activated, but without Pingboard credentials
+	p.scheduleRefresh(time.Hour)
+	defer p.stopRefreshTimer()
+	if _, err := p.refresh(func(string) {}); err == nil {
+		t.Log("expected refreshing without credentials to fail")
+		t.Fail()
+	}
+	status := p.getRefreshStatus()
+	if len(status.RecentErrors) != 0 || !status.NotConfigured {
+		t.Logf("expected only the missing configuration to be recorded, got %+v", status)
+		t.Fail()
+	}
+	if status.Running || !p.nextRefreshAt().IsZero() {
+		t.Logf("expected no refresh running or scheduled, got %+v, next at %v", status, p.nextRefreshAt())
+		t.Fail()
+	}
+
+	// once configured, the next refresh clears it
+	p.refreshStarted(time.Now())
+	if p.getRefreshStatus().NotConfigured {
+		t.Log("expected a refresh that starts to clear the missing configuration")
+		t.Fail()
+	}
+}
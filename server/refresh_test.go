@@ -0,0 +1,186 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin"
+
+	"github.com/imc/mattermost-plugin-pingboard/server/pingboard"
+)
+
+// logOnlyAPI is a plugin API that only supports logging, for testing code that logs
+// but otherwise works on data already fetched. Any other call panics.
+type logOnlyAPI struct {
+	plugin.API
+}
+
+func (logOnlyAPI) LogDebug(string, ...interface{}) {}
+func (logOnlyAPI) LogInfo(string, ...interface{})  {}
+func (logOnlyAPI) LogWarn(string, ...interface{})  {}
+func (logOnlyAPI) LogError(string, ...interface{}) {}
+
+func newLogOnlyPlugin() *Plugin {
+	p := &Plugin{}
+	p.SetAPI(logOnlyAPI{})
+	return p
+}
+
+func TestRefreshDelay(t *testing.T) {
+	first := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		sinceFirst time.Duration
+		expected   time.Duration
+	}{
+		{sinceFirst: 0, expected: refreshDebounce},
+		{sinceFirst: 5 * time.Minute, expected: refreshDebounce},
+		{sinceFirst: refreshMaxDelay - refreshDebounce, expected: refreshDebounce},
+		{sinceFirst: refreshMaxDelay - 10*time.Second, expected: 10 * time.Second},
+		{sinceFirst: refreshMaxDelay, expected: 0},
+	} {
+		if delay := refreshDelay(first, first.Add(tc.sinceFirst)); delay != tc.expected {
+			t.Logf("%s after the first request: expected %s, got %s", tc.sinceFirst, tc.expected, delay)
+			t.Fail()
+		}
+	}
+}
+
+// testMatchDirectory returns a directory in which alice is matched, and reports to bob,
+// who is in Pingboard but has no Mattermost account yet.
+func testMatchDirectory(p *Plugin) *directory {
+	pbData := &pingboardData{
+		company: &pingboard.Company{Domain: "example"},
+		usersById: map[string]pingboard.User{
+			"pb-alice": {Id: "pb-alice", Email: "alice@example.com", ReportsToId: "pb-bob"},
+			"pb-bob":   {Id: "pb-bob", Email: "Bob@Example.com"},
+			"pb-dup1":  {Id: "pb-dup1", Email: "dup@example.com"},
+			"pb-dup2":  {Id: "pb-dup2", Email: "D-up@Example.com"},
+		},
+	}
+	mmUserIdsByNormalisedEmail := map[string]string{"alice@example.com": "alice"}
+	dir := newDirectory(map[string]User{
+		"alice": p.resolveUser(pbData, pbData.usersById["pb-alice"], "alice", mmUserIdsByNormalisedEmail),
+	})
+	dir.pingboardData = pbData
+	dir.mmUserIdsByNormalisedEmail = mmUserIdsByNormalisedEmail
+	return dir
+}
+
+func TestMatchNewUser(t *testing.T) {
+	for name, tc := range map[string]struct {
+		mmUser          model.User
+		noData          bool
+		expectedMatched bool
+		expectedUsers   map[string]string // Pingboard ID by mattermost user ID
+		expectedManager string            // of alice
+	}{
+		"no data yet": {
+			mmUser:          model.User{Id: "bob", Email: "bob@example.com"},
+			noData:          true,
+			expectedMatched: false,
+		},
+		"not in pingboard": {
+			mmUser:          model.User{Id: "carol", Email: "carol@example.com"},
+			expectedMatched: false,
+			expectedUsers:   map[string]string{"alice": "pb-alice"},
+		},
+		"manager links reports": {
+			mmUser:          model.User{Id: "bob", Email: "bob@example.com"},
+			expectedMatched: true,
+			expectedUsers:   map[string]string{"alice": "pb-alice", "bob": "pb-bob"},
+			expectedManager: "bob",
+		},
+		"email of an existing mattermost user": {
+			mmUser:          model.User{Id: "alice2", Email: "Alice@example.com"},
+			expectedMatched: true,
+			expectedUsers:   map[string]string{"alice": "pb-alice"},
+		},
+		"email of several pingboard users": {
+			mmUser:          model.User{Id: "dup", Email: "dup@example.com"},
+			expectedMatched: true,
+			expectedUsers:   map[string]string{"alice": "pb-alice"},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			p := newLogOnlyPlugin()
+			if !tc.noData {
+				p.directory = testMatchDirectory(p)
+			}
+			mmUser := tc.mmUser
+			if matched := p.matchNewUser(&mmUser); matched != tc.expectedMatched {
+				t.Logf("expected matched %v, got %v", tc.expectedMatched, matched)
+				t.Fail()
+			}
+			if tc.noData {
+				return
+			}
+			dir := p.getDirectory()
+			users := map[string]string{}
+			for userId, user := range dir.usersById {
+				users[userId] = user.Id
+			}
+			if len(users) != len(tc.expectedUsers) {
+				t.Logf("expected users %v, got %v", tc.expectedUsers, users)
+				t.Fail()
+			}
+			for userId, pbId := range tc.expectedUsers {
+				if users[userId] != pbId {
+					t.Logf("expected users %v, got %v", tc.expectedUsers, users)
+					t.Fail()
+				}
+			}
+			if manager := dir.usersById["alice"].ManagerId; manager != tc.expectedManager {
+				t.Logf("expected alice's manager %q, got %q", tc.expectedManager, manager)
+				t.Fail()
+			}
+		})
+	}
+}
+
+func TestNewUsersQueuedDuringRefresh(t *testing.T) {
+	p := newLogOnlyPlugin()
+	p.noteNewUser(&model.User{Id: "before"})
+	p.queueNewUsers()
+	p.noteNewUser(&model.User{Id: "during"})
+	queued := p.takeQueuedNewUsers()
+	p.noteNewUser(&model.User{Id: "after"})
+
+	if len(queued) != 1 || queued[0].Id != "during" {
+		t.Logf("expected only the user created during the refresh to be queued, got %v", queued)
+		t.Fail()
+	}
+	if again := p.takeQueuedNewUsers(); len(again) != 0 {
+		t.Logf("expected nothing queued after the refresh, got %v", again)
+		t.Fail()
+	}
+}
+
+func TestMatchNewUsers(t *testing.T) {
+	p := newLogOnlyPlugin()
+	p.directory = testMatchDirectory(p)
+	p.directory.pingboardData.usersById["pb-carol"] = pingboard.User{Id: "pb-carol", Email: "carol@example.com", ReportsToId: "pb-bob"}
+
+	matched := p.matchNewUsers([]*model.User{
+		{Id: "carol", Email: "carol@example.com"},
+		{Id: "erin", Email: "erin@example.com"},
+		{Id: "bob", Email: "bob@example.com"},
+	})
+	if expected := []bool{true, false, true}; !reflect.DeepEqual(matched, expected) {
+		t.Logf("expected matched %v, got %v", expected, matched)
+		t.Fail()
+	}
+	dir := p.getDirectory()
+	if len(dir.usersById) != 3 {
+		t.Logf("expected alice, bob and carol in the directory, got %v", dir.usersById)
+		t.Fail()
+	}
+	// carol comes before bob in the batch, but is still linked to bob
+	for _, userId := range []string{"alice", "carol"} {
+		if manager := dir.usersById[userId].ManagerId; manager != "bob" {
+			t.Logf("expected %s's manager to be bob, got %q", userId, manager)
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+// All endpoints are served under a versioned prefix, so that they can change incompatibly
+// in a later version without breaking existing clients.
+const apiV1Prefix = "/api/v1"
+
+// Who may call a route
+const (
+	authUser        = iota // any logged-in Mattermost user
+	authSystemAdmin        // system admins only
+	authWebhook            // external callers, who sign the body with the webhook secret
+	authPlugin             // other plugins on the same server, through the PluginHTTP API
+)
+
+const (
+	pluginIdHeader  = "Mattermost-Plugin-ID" // set by the server on requests from other plugins
+	requestIdHeader = "X-Request-ID"
+	signatureHeader = "X-Signature" // "sha256=" and the hex HMAC-SHA256 of the body
+)
+
+// The most that is read of a webhook body to check its signature
+const maxWebhookBodyBytes = 1 << 20
+
+// Request IDs given by the client are only passed on if they look like one.
+var validRequestId = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+type route struct {
+	method    string
+	path      string // may contain {param} segments
+	auth      int
+	cacheable bool // the response is made from the directory, so clients may cache it
+	handler   func(w http.ResponseWriter, r *http.Request)
+}
+
+type pathParamsKey struct{}
+
+// pathParam returns the value of a {param} segment of the route's path.
+func pathParam(r *http.Request, name string) string {
+	params, _ := r.Context().Value(pathParamsKey{}).(map[string]string)
+	return params[name]
+}
+
+func (p *Plugin) routes() []route {
+	return []route{
+		{method: http.MethodGet, path: "/user", auth: authUser, cacheable: true, handler: p.handleGetUser},
+		{method: http.MethodPost, path: "/users", auth: authUser, handler: p.handlePostUsers},
+		{method: http.MethodGet, path: "/user/chain", auth: authUser, cacheable: true, handler: p.handleGetChain},
+		{method: http.MethodGet, path: "/user/reports", auth: authUser, cacheable: true, handler: p.handleGetReports},
+		{method: http.MethodGet, path: "/user/vcard", auth: authUser, cacheable: true, handler: p.handleGetVCard},
+		{method: http.MethodGet, path: "/search", auth: authUser, cacheable: true, handler: p.handleSearch},
+		{method: http.MethodGet, path: "/orgchart", auth: authUser, cacheable: true, handler: p.handleGetOrgChart},
+		{method: http.MethodGet, path: "/departments", auth: authUser, cacheable: true, handler: p.handleGetDepartments},
+		{method: http.MethodGet, path: "/departments/{name}/members", auth: authUser, cacheable: true, handler: p.handleGetDepartmentMembers},
+		{method: http.MethodGet, path: "/autocomplete/departments", auth: authUser, handler: p.handleGetDepartmentAutocomplete},
+		{method: http.MethodGet, path: "/user/profile-locks", auth: authUser, handler: p.handleGetProfileLocks},
+		{method: http.MethodPut, path: "/user/profile-locks", auth: authUser, handler: p.handlePutProfileLocks},
+		{method: http.MethodGet, path: "/profile-sync/report", auth: authSystemAdmin, handler: p.handleGetProfileSyncReport},
+		{method: http.MethodGet, path: "/channel-rules/report", auth: authSystemAdmin, handler: p.handleGetChannelRulesReport},
+		{method: http.MethodGet, path: "/channel-rules/audit", auth: authSystemAdmin, handler: p.handleGetChannelRulesAudit},
+		{method: http.MethodGet, path: "/offboarding/report", auth: authSystemAdmin, handler: p.handleGetOffboardingReport},
+		{method: http.MethodGet, path: "/export", auth: authSystemAdmin, handler: p.handleGetExport},
+		{method: http.MethodGet, path: "/lookup-audit", auth: authSystemAdmin, handler: p.handleGetLookupAudit},
+		{method: http.MethodGet, path: "/status", auth: authSystemAdmin, handler: p.handleGetStatus},
+
+		// For other plugins, with the same responses as the endpoints for users
+		{method: http.MethodGet, path: "/plugin/user", auth: authPlugin, handler: p.handleGetUser},
+		{method: http.MethodPost, path: "/plugin/users", auth: authPlugin, handler: p.handlePostUsers},
+		{method: http.MethodGet, path: "/plugin/user/chain", auth: authPlugin, handler: p.handleGetChain},
+		{method: http.MethodGet, path: "/plugin/user/reports", auth: authPlugin, handler: p.handleGetReports},
+		{method: http.MethodGet, path: "/plugin/departments", auth: authPlugin, handler: p.handleGetDepartments},
+		{method: http.MethodGet, path: "/plugin/departments/{name}/members", auth: authPlugin, handler: p.handleGetDepartmentMembers},
+	}
+}
+
+// matchPath returns the values of the {param} segments if the (escaped) path matches the
+// route's path.
+func matchPath(routePath string, escapedPath string) (map[string]string, bool) {
+	routeSegments := strings.Split(routePath, "/")
+	segments := strings.Split(escapedPath, "/")
+	if len(routeSegments) != len(segments) {
+		return nil, false
+	}
+	params := map[string]string{}
+	for i, routeSegment := range routeSegments {
+		if strings.HasPrefix(routeSegment, "{") && strings.HasSuffix(routeSegment, "}") {
+			value, err := url.PathUnescape(segments[i])
+			if err != nil || value == "" {
+				return nil, false
+			}
+			params[strings.Trim(routeSegment, "{}")] = value
+		} else if routeSegment != segments[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+// requestId returns the ID to identify the request by in logs and error responses: the one
+// given by the client, if any, or else a new one.
+func requestId(r *http.Request) string {
+	if id := r.Header.Get(requestIdHeader); validRequestId.MatchString(id) {
+		return id
+	}
+	return model.NewId()
+}
+
+// authorize checks that the caller may call the route. If not, an error response has
+// already been written.
+func (p *Plugin) authorize(w http.ResponseWriter, r *http.Request, rt route) bool {
+	if rt.auth == authWebhook {
+		return p.requireWebhookSignature(w, r)
+	}
+	if rt.auth == authPlugin {
+		return p.requirePlugin(w, r)
+	}
+	if r.Header.Get("Mattermost-User-ID") == "" {
+		p.writeApiError(w, http.StatusUnauthorized, "not authorized")
+		return false
+	}
+	if rt.auth == authSystemAdmin {
+		return p.requireSystemAdmin(w, r)
+	}
+	return true
+}
+
+// requireWebhookSignature checks that the request body was signed with the configured
+// webhook secret. The body is left to be read again by the handler. If the signature is
+// not valid, an error response has already been written.
+func (p *Plugin) requireWebhookSignature(w http.ResponseWriter, r *http.Request) bool {
+	secret := p.getConfiguration().WebhookSecret
+	if secret == "" {
+		p.API.LogDebug("Returning not found for webhook (no webhook secret configured)")
+		p.writeApiError(w, http.StatusNotFound, "not found")
+		return false
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxWebhookBodyBytes))
+	if err != nil {
+		p.writeApiError(w, http.StatusBadRequest, "failed to read body")
+		return false
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write(body)
+	expected := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	if !hmac.Equal([]byte(r.Header.Get(signatureHeader)), []byte(expected)) {
+		p.API.LogWarn("Rejected webhook with invalid signature", "request_id", w.Header().Get(requestIdHeader))
+		p.writeApiError(w, http.StatusUnauthorized, "invalid signature")
+		return false
+	}
+	return true
+}
+
+// isPluginRequest returns whether the request was made by another plugin rather than for
+// a user.
+func isPluginRequest(r *http.Request) bool {
+	return r.Header.Get(pluginIdHeader) != "" && r.Header.Get("Mattermost-User-ID") == ""
+}
+
+// requirePlugin checks that the request was made by another plugin that is allowed to use
+// the API. If not, an error response has already been written.
+func (p *Plugin) requirePlugin(w http.ResponseWriter, r *http.Request) bool {
+	if !isPluginRequest(r) {
+		p.writeApiError(w, http.StatusUnauthorized, "only available to other plugins")
+		return false
+	}
+	// other plugins see every field, so none may call unless the admin listed them
+	pluginId := r.Header.Get(pluginIdHeader)
+	found := false
+	for _, allowedId := range strings.Split(p.getConfiguration().InterPluginAllowedIds, ",") {
+		found = found || strings.TrimSpace(allowedId) == pluginId
+	}
+	if !found {
+		p.API.LogWarn("Rejected request from plugin not allowed to use the API", "plugin_id", pluginId)
+		p.writeApiError(w, http.StatusForbidden, "plugin not allowed")
+		return false
+	}
+	return true
+}
+
+// serveApi dispatches a request to the route matching its method and path, under the API
+// prefix, after checking the caller may call it.
+func (p *Plugin) serveApi(w http.ResponseWriter, r *http.Request, escapedPath string) {
+	var allowed []string
+	for _, rt := range p.routes() {
+		params, found := matchPath(rt.path, escapedPath)
+		if !found {
+			continue
+		}
+		if rt.method != r.Method {
+			allowed = append(allowed, rt.method)
+			continue
+		}
+
+		if !p.authorize(w, r, rt) || !p.checkRateLimit(w, r, rt) {
+			return
+		}
+		r = r.WithContext(context.WithValue(r.Context(), pathParamsKey{}, params))
+		if rt.cacheable {
+			p.serveCacheable(w, r, rt.handler)
+			return
+		}
+		rt.handler(w, r)
+		return
+	}
+
+	if len(allowed) > 0 {
+		sort.Strings(allowed)
+		w.Header().Set("Allow", strings.Join(allowed, ", "))
+		p.writeApiError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	p.writeApiError(w, http.StatusNotFound, "not found")
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestMatchPath(t *testing.T) {
+	for name, tc := range map[string]struct {
+		routePath      string
+		path           string
+		expectedMatch  bool
+		expectedParams map[string]string
+	}{
+		"same path": {
+			routePath:      "/user/chain",
+			path:           "/user/chain",
+			expectedMatch:  true,
+			expectedParams: map[string]string{},
+		},
+		"different path": {
+			routePath:     "/user/chain",
+			path:          "/user/reports",
+			expectedMatch: false,
+		},
+		"prefix of path": {
+			routePath:     "/user",
+			path:          "/user/chain",
+			expectedMatch: false,
+		},
+		"param": {
+			routePath:      "/departments/{name}/members",
+			path:           "/departments/Trading/members",
+			expectedMatch:  true,
+			expectedParams: map[string]string{"name": "Trading"},
+		},
+		"escaped param": {
+			routePath:      "/departments/{name}/members",
+			path:           "/departments/Sales%2FMarketing%20EU/members",
+			expectedMatch:  true,
+			expectedParams: map[string]string{"name": "Sales/Marketing EU"},
+		},
+		"empty param": {
+			routePath:     "/departments/{name}/members",
+			path:          "/departments//members",
+			expectedMatch: false,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			params, match := matchPath(tc.routePath, tc.path)
+
+			if match != tc.expectedMatch {
+				t.Logf("expected match: %v, got %v", tc.expectedMatch, match)
+				t.Fail()
+			}
+			if match && !reflect.DeepEqual(params, tc.expectedParams) {
+				t.Logf("expected params: %v, got %v", tc.expectedParams, params)
+				t.Fail()
+			}
+		})
+	}
+}
+
+// apiErrorResponse is the error envelope of the HTTP API.
+type apiErrorResponse struct {
+	Error     string `json:"error"`
+	RequestId string `json:"request_id"`
+}
+
+func TestServeHTTPErrors(t *testing.T) {
+	for name, tc := range map[string]struct {
+		method            string
+		path              string
+		userId            string
+		requestId         string
+		expectedStatus    int
+		expectedAllow     string
+		expectedRequestId string // empty for a new one
+	}{
+		"method not allowed": {
+			method: http.MethodDelete, path: "/api/v1/user/profile-locks", userId: "bob",
+			expectedStatus: http.StatusMethodNotAllowed, expectedAllow: "GET, PUT",
+		},
+		"not logged in": {
+			method: http.MethodGet, path: "/api/v1/user", requestId: "client-id.1",
+			expectedStatus: http.StatusUnauthorized, expectedRequestId: "client-id.1",
+		},
+		"not an admin": {
+			method: http.MethodGet, path: "/api/v1/status", userId: "bob",
+			expectedStatus: http.StatusForbidden,
+		},
+		"unversioned path": {
+			method: http.MethodGet, path: "/export", userId: "bob", requestId: "not a valid id",
+			expectedStatus: http.StatusForbidden,
+		},
+		"unknown path": {
+			method: http.MethodGet, path: "/api/v2/user", userId: "bob",
+			expectedStatus: http.StatusNotFound,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			api := &plugintest.API{}
+			api.On("HasPermissionTo", "bob", model.PermissionManageSystem).Return(false)
+			p := &Plugin{}
+			p.SetAPI(api)
+			r := httptest.NewRequest(tc.method, tc.path, nil)
+			if tc.userId != "" {
+				r.Header.Set("Mattermost-User-ID", tc.userId)
+			}
+			if tc.requestId != "" {
+				r.Header.Set(requestIdHeader, tc.requestId)
+			}
+			w := httptest.NewRecorder()
+
+			p.ServeHTTP(nil, w, r)
+			if w.Code != tc.expectedStatus {
+				t.Logf("expected status %d, got %d", tc.expectedStatus, w.Code)
+				t.Fail()
+			}
+			if allow := w.Header().Get("Allow"); allow != tc.expectedAllow {
+				t.Logf("expected Allow %q, got %q", tc.expectedAllow, allow)
+				t.Fail()
+			}
+			var response apiErrorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil || response.Error == "" {
+				t.Logf("expected an error response, got %s", w.Body)
+				t.Fail()
+			}
+			headerId := w.Header().Get(requestIdHeader)
+			if response.RequestId != headerId || (tc.expectedRequestId != "" && headerId != tc.expectedRequestId) ||
+				(tc.expectedRequestId == "" && headerId == tc.requestId) {
+				t.Logf("expected request ID %q in the header and body, got %q and %q", tc.expectedRequestId, headerId,
+					response.RequestId)
+				t.Fail()
+			}
+		})
+	}
+}
+
+func TestRequireWebhookSignature(t *testing.T) {
+	body := []byte(`{"event": "changed"}`)
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	_, _ = mac.Write(body)
+	valid := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	for name, tc := range map[string]struct {
+		secret         string
+		signature      string
+		expectedStatus int // 0 if accepted
+	}{
+		"valid":             {secret: "s3cret", signature: valid},
+		"invalid":           {secret: "s3cret", signature: "sha256=00", expectedStatus: http.StatusUnauthorized},
+		"missing":           {secret: "s3cret", expectedStatus: http.StatusUnauthorized},
+		"no secret":         {signature: valid, expectedStatus: http.StatusNotFound},
+		"signed for others": {secret: "other", signature: valid, expectedStatus: http.StatusUnauthorized},
+	} {
+		t.Run(name, func(t *testing.T) {
+			api := &plugintest.API{}
+			api.On("LogDebug", mock.Anything).Maybe()
+			api.On("LogWarn", mock.Anything, mock.Anything, mock.Anything).Maybe()
+			p := &Plugin{configuration: &configuration{WebhookSecret: tc.secret}}
+			p.SetAPI(api)
+			r := httptest.NewRequest(http.MethodPost, "/api/v1/webhooks/example", bytes.NewReader(body))
+			if tc.signature != "" {
+				r.Header.Set(signatureHeader, tc.signature)
+			}
+			w := httptest.NewRecorder()
+
+			accepted := p.authorize(w, r, route{auth: authWebhook})
+			if accepted != (tc.expectedStatus == 0) || (!accepted && w.Code != tc.expectedStatus) {
+				t.Logf("expected status %d, got accepted %v with %d", tc.expectedStatus, accepted, w.Code)
+				t.Fail()
+			}
+			if accepted {
+				if read, _ := io.ReadAll(r.Body); !bytes.Equal(read, body) {
+					t.Logf("expected the body to be left for the handler, got %q", read)
+					t.Fail()
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Shortest phone number suffix that can be searched for, e.g. an extension
+const minPhoneSuffixLength = 3
+
+var searchTokenSeparators = regexp.MustCompile(`[^\p{L}\p{N}]+`)
+
+var phoneNonDigits = regexp.MustCompile(`[^0-9]`)
+
+// Ranks of how well a search term matched a user's name; lower is better
+const (
+	searchRankExact = iota
+	searchRankPrefix
+	searchRankFuzzy
+)
+
+type searchToken struct {
+	token  string
+	userId string
+	field  string // the field it came from: the name, or the email address
+}
+
+// searchIndex indexes the users in a directory for searching by name and by field.
+type searchIndex struct {
+	tokens        []searchToken // sorted by token, then user ID, for prefix search by binary search
+	vocabulary    []string      // distinct tokens, for fuzzy search
+	sortKeys      map[string]string
+	byDepartment  map[string][]string
+	byLocation    map[string][]string
+	byJobTitle    map[string][]string
+	byPhoneSuffix map[string][]string
+}
+
+type searchQuery struct {
+	text       string // terms to match against names; all must match
+	fuzzy      bool   // allow terms to match names with small typos
+	department string
+	location   string
+	jobTitle   string
+	phone      string // matches the end of the phone number, ignoring anything but digits
+
+	// whether the text may match the field of the given user; nil if it may match any
+	canSee func(field string, userId string) bool
+}
+
+func searchTokens(text string) []string {
+	tokens := []string{}
+	for _, token := range searchTokenSeparators.Split(strings.ToLower(text), -1) {
+		if token != "" {
+			tokens = append(tokens, token)
+		}
+	}
+	return tokens
+}
+
+func newSearchIndex(usersById map[string]User) *searchIndex {
+	index := &searchIndex{
+		sortKeys:      map[string]string{},
+		byDepartment:  map[string][]string{},
+		byLocation:    map[string][]string{},
+		byJobTitle:    map[string][]string{},
+		byPhoneSuffix: map[string][]string{},
+	}
+
+	vocabulary := map[string]bool{}
+	for userId, user := range usersById {
+		emailName, _, _ := strings.Cut(user.Email, "@")
+		seen := map[string]bool{}
+		for _, field := range []struct {
+			name string
+			text string
+		}{
+			{visibleFieldName, strings.Join([]string{user.FirstName, user.LastName, user.Nickname}, " ")},
+			{visibleFieldEmail, emailName},
+		} {
+			for _, token := range searchTokens(field.text) {
+				if seen[token] {
+					continue
+				}
+				seen[token] = true
+				vocabulary[token] = true
+				index.tokens = append(index.tokens, searchToken{token: token, userId: userId, field: field.name})
+			}
+		}
+		index.sortKeys[userId] = strings.ToLower(user.LastName + "\x00" + user.FirstName + "\x00" + userId)
+
+		if user.Department != "" {
+			key := strings.ToLower(user.Department)
+			index.byDepartment[key] = append(index.byDepartment[key], userId)
+		}
+		if user.Location != "" {
+			key := strings.ToLower(user.Location)
+			index.byLocation[key] = append(index.byLocation[key], userId)
+		}
+		if user.JobTitle != "" {
+			key := strings.ToLower(user.JobTitle)
+			index.byJobTitle[key] = append(index.byJobTitle[key], userId)
+		}
+		digits := phoneNonDigits.ReplaceAllString(user.Phone, "")
+		for i := 0; i <= len(digits)-minPhoneSuffixLength; i++ {
+			index.byPhoneSuffix[digits[i:]] = append(index.byPhoneSuffix[digits[i:]], userId)
+		}
+	}
+
+	sort.Slice(index.tokens, func(i, j int) bool {
+		if index.tokens[i].token != index.tokens[j].token {
+			return index.tokens[i].token < index.tokens[j].token
+		}
+		return index.tokens[i].userId < index.tokens[j].userId
+	})
+	for token := range vocabulary {
+		index.vocabulary = append(index.vocabulary, token)
+	}
+	sort.Strings(index.vocabulary)
+
+	return index
+}
+
+// matchTerm returns the best rank with which the term matches each user, by the fields
+// that may be matched.
+func (index *searchIndex) matchTerm(term string, fuzzy bool, canSee func(string, string) bool) map[string]int {
+	ranks := map[string]int{}
+	record := func(token searchToken, rank int) {
+		if canSee != nil && !canSee(token.field, token.userId) {
+			return
+		}
+		if best, found := ranks[token.userId]; !found || rank < best {
+			ranks[token.userId] = rank
+		}
+	}
+	// the index of the first token not below the given one
+	find := func(token string) int {
+		return sort.Search(len(index.tokens), func(i int) bool { return index.tokens[i].token >= token })
+	}
+
+	for i := find(term); i < len(index.tokens) && strings.HasPrefix(index.tokens[i].token, term); i++ {
+		if index.tokens[i].token == term {
+			record(index.tokens[i], searchRankExact)
+		} else {
+			record(index.tokens[i], searchRankPrefix)
+		}
+	}
+
+	if fuzzy {
+		maxDistance := 1
+		if len(term) >= 8 {
+			maxDistance = 2
+		}
+		for _, token := range index.vocabulary {
+			if !editDistanceWithin(term, token, maxDistance) {
+				continue
+			}
+			for i := find(token); i < len(index.tokens) && index.tokens[i].token == token; i++ {
+				record(index.tokens[i], searchRankFuzzy)
+			}
+		}
+	}
+	return ranks
+}
+
+// search returns the IDs of the users matching the query, best matches first and
+// otherwise ordered by last name, first name and user ID.
+func (index *searchIndex) search(query searchQuery) []string {
+	var candidates map[string]int // user ID to total rank; nil means everyone
+	restrict := func(userIds []string, ranks map[string]int) {
+		next := map[string]int{}
+		for _, userId := range userIds {
+			if rank, found := candidates[userId]; candidates == nil || found {
+				next[userId] = rank + ranks[userId]
+			}
+		}
+		candidates = next
+	}
+	keys := func(ranks map[string]int) []string {
+		userIds := make([]string, 0, len(ranks))
+		for userId := range ranks {
+			userIds = append(userIds, userId)
+		}
+		return userIds
+	}
+
+	if query.department != "" {
+		restrict(index.byDepartment[strings.ToLower(query.department)], nil)
+	}
+	if query.location != "" {
+		restrict(index.byLocation[strings.ToLower(query.location)], nil)
+	}
+	if query.jobTitle != "" {
+		restrict(index.byJobTitle[strings.ToLower(query.jobTitle)], nil)
+	}
+	if query.phone != "" {
+		restrict(index.byPhoneSuffix[phoneNonDigits.ReplaceAllString(query.phone, "")], nil)
+	}
+	for _, term := range searchTokens(query.text) {
+		ranks := index.matchTerm(term, query.fuzzy, query.canSee)
+		restrict(keys(ranks), ranks)
+	}
+
+	if candidates == nil {
+		candidates = map[string]int{}
+		for userId := range index.sortKeys {
+			candidates[userId] = 0
+		}
+	}
+	userIds := keys(candidates)
+	sort.Slice(userIds, func(i, j int) bool {
+		if candidates[userIds[i]] != candidates[userIds[j]] {
+			return candidates[userIds[i]] < candidates[userIds[j]]
+		}
+		return index.sortKeys[userIds[i]] < index.sortKeys[userIds[j]]
+	})
+	return userIds
+}
+
+// editDistanceWithin returns whether a can be turned into b with at most maxDistance
+// single character insertions, deletions or substitutions.
+func editDistanceWithin(a string, b string, maxDistance int) bool {
+	ra, rb := []rune(a), []rune(b)
+	if len(ra)-len(rb) > maxDistance || len(rb)-len(ra) > maxDistance {
+		return false
+	}
+	previous := make([]int, len(rb)+1)
+	current := make([]int, len(rb)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(ra); i++ {
+		current[0] = i
+		rowMin := current[0]
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+			current[j] = min(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+			rowMin = min(rowMin, current[j])
+		}
+		if rowMin > maxDistance {
+			return false
+		}
+		previous, current = current, previous
+	}
+	return previous[len(rb)] <= maxDistance
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSearch(t *testing.T) {
+	index := newSearchIndex(map[string]User{
+		"u1": {FirstName: "Alice", LastName: "Smith", Email: "alice.smith@example.com", Department: "Risk",
+			Location: "Amsterdam", Phone: "+31 20 555 4521"},
+		"u2": {FirstName: "Alicia", LastName: "Jones", Department: "Trading", Location: "Amsterdam",
+			JobTitle: "Trader", Phone: "+31 20 555 1234"},
+		"u3": {FirstName: "Bob", LastName: "Smithson", Nickname: "Bobby", Department: "Risk", Location: "Chicago"},
+	})
+
+	for name, tc := range map[string]struct {
+		query    searchQuery
+		expected []string
+	}{
+		"everyone, by last name": {
+			query:    searchQuery{},
+			expected: []string{"u2", "u1", "u3"},
+		},
+		"exact match before prefix match": {
+			query:    searchQuery{text: "smith"},
+			expected: []string{"u1", "u3"},
+		},
+		"prefix": {
+			query:    searchQuery{text: "ali"},
+			expected: []string{"u2", "u1"},
+		},
+		"all terms must match": {
+			query:    searchQuery{text: "ali smi"},
+			expected: []string{"u1"},
+		},
+		"nickname": {
+			query:    searchQuery{text: "bobby"},
+			expected: []string{"u3"},
+		},
+		"no fuzzy match unless asked": {
+			query:    searchQuery{text: "smoth"},
+			expected: []string{},
+		},
+		"fuzzy": {
+			query:    searchQuery{text: "smoth", fuzzy: true},
+			expected: []string{"u1"},
+		},
+		"department ignoring case": {
+			query:    searchQuery{department: "risk"},
+			expected: []string{"u1", "u3"},
+		},
+		"department and location": {
+			query:    searchQuery{department: "Risk", location: "Amsterdam"},
+			expected: []string{"u1"},
+		},
+		"job title": {
+			query:    searchQuery{jobTitle: "trader"},
+			expected: []string{"u2"},
+		},
+		"phone extension": {
+			query:    searchQuery{phone: "4521"},
+			expected: []string{"u1"},
+		},
+		"phone with formatting": {
+			query:    searchQuery{phone: "555-1234"},
+			expected: []string{"u2"},
+		},
+		"unknown department": {
+			query:    searchQuery{department: "Legal"},
+			expected: []string{},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if userIds := index.search(tc.query); !reflect.DeepEqual(userIds, tc.expected) {
+				t.Logf("expected %v, got %v", tc.expected, userIds)
+				t.Fail()
+			}
+		})
+	}
+}
+
+func TestSearchByEmailVisibility(t *testing.T) {
+	index := newSearchIndex(map[string]User{
+		"u1": {FirstName: "John", LastName: "Doe", Email: "jsmith2@example.com"},
+		"u2": {FirstName: "Jane", LastName: "Smith", Email: "jane.smith@example.com"},
+	})
+	emailHidden := func(field string, userId string) bool { return field != visibleFieldEmail }
+
+	for name, tc := range map[string]struct {
+		query    searchQuery
+		expected []string
+	}{
+		"email visible": {
+			query:    searchQuery{text: "jsmith2"},
+			expected: []string{"u1"},
+		},
+		"email hidden": {
+			query:    searchQuery{text: "jsmith2", canSee: emailHidden},
+			expected: []string{},
+		},
+		"email hidden, fuzzy": {
+			query:    searchQuery{text: "jsmith3", fuzzy: true, canSee: emailHidden},
+			expected: []string{},
+		},
+		"name also in the email": {
+			query:    searchQuery{text: "smith", canSee: emailHidden},
+			expected: []string{"u2"},
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			if userIds := index.search(tc.query); !reflect.DeepEqual(userIds, tc.expected) {
+				t.Logf("expected %v, got %v", tc.expected, userIds)
+				t.Fail()
+			}
+		})
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// handleGetStatus returns the state of the plugin for admins: the directory currently
+// served, how the refreshes went, and how the API is being used.
+func (p *Plugin) handleGetStatus(w http.ResponseWriter, r *http.Request) {
+	type Directory struct {
+		Version string    `json:"version"`
+		BuiltAt time.Time `json:"built_at"`
+		Users   int       `json:"users"`
+	}
+	type RateLimits struct {
+		Enabled      bool              `json:"enabled"`
+		TrackedUsers int               `json:"tracked_users"` // users who made requests recently
+		Endpoints    []rateLimitCounts `json:"endpoints"`     // since the plugin started
+	}
+	type Refresh struct {
+		refreshStatus
+		NextRunAt *time.Time `json:"next_run_at"` // unless no refresh is scheduled
+	}
+	type Status struct {
+		Directory  *Directory `json:"directory"` // unless there is no data yet
+		Refresh    Refresh    `json:"refresh"`
+		RateLimits RateLimits `json:"rate_limits"`
+	}
+
+	status := Status{}
+	if dir := p.getDirectory(); dir != nil {
+		status.Directory = &Directory{Version: dir.version, BuiltAt: dir.builtAt, Users: len(dir.usersById)}
+	}
+	status.Refresh.refreshStatus = p.getRefreshStatus()
+	if nextRunAt := p.nextRefreshAt(); !nextRunAt.IsZero() {
+		status.Refresh.NextRunAt = &nextRunAt
+	}
+	status.RateLimits.Enabled = p.getConfiguration().RateLimitEnabled
+	status.RateLimits.Endpoints, status.RateLimits.TrackedUsers = p.rateLimiter.counts()
+	p.writeApiResponse(w, status)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin"
+)
+
+// userRef identifies a mattermost user in API responses.
+type userRef struct {
+	UserId   string `json:"user_id"`
+	Username string `json:"username"`
+}
+
+const (
+	usernameBatchThreshold = 50
+	usernamePageSize       = 200
+)
+
+// usernameCache looks up the current usernames of mattermost users by ID. Usernames
+// can change at any time, so a cache should only live as long as a single request.
+type usernameCache struct {
+	pluginAPI plugin.API
+	byUserId  map[string]string
+}
+
+func (p *Plugin) newUsernameCache() *usernameCache {
+	return &usernameCache{
+		pluginAPI: p.API,
+		byUserId:  map[string]string{},
+	}
+}
+
+// username returns the user's username, or an empty string if the user could not be found.
+func (c *usernameCache) username(userId string) string {
+	if username, found := c.byUserId[userId]; found {
+		return username
+	}
+	username := ""
+	if user, err := c.pluginAPI.GetUser(userId); err != nil {
+		c.pluginAPI.LogWarn("Failed to get mattermost user", "user_id", userId, "error", err)
+	} else {
+		username = user.Username
+	}
+	c.byUserId[userId] = username
+	return username
+}
+
+// load looks up the usernames of many users at once. Above usernameBatchThreshold users
+// not looked up yet, every user is fetched a page at a time, which takes far fewer calls
+// than fetching them one by one.
+func (c *usernameCache) load(userIds []string) {
+	missing := map[string]bool{}
+	for _, userId := range userIds {
+		if _, found := c.byUserId[userId]; !found {
+			missing[userId] = true
+		}
+	}
+	if len(missing) <= usernameBatchThreshold {
+		return // looked up one by one as needed
+	}
+	for page := 0; len(missing) > 0; page++ {
+		users, err := c.pluginAPI.GetUsers(&model.UserGetOptions{Page: page, PerPage: usernamePageSize})
+		if err != nil {
+			c.pluginAPI.LogWarn("Failed to get mattermost users", "error", err)
+			return
+		}
+		for _, user := range users {
+			if missing[user.Id] {
+				c.byUserId[user.Id] = user.Username
+				delete(missing, user.Id)
+			}
+		}
+		if len(users) < usernamePageSize {
+			break
+		}
+	}
+	// users who no longer exist
+	for userId := range missing {
+		c.byUserId[userId] = ""
+	}
+}
+
+func (c *usernameCache) refs(userIds []string) []userRef {
+	c.load(userIds)
+	refs := make([]userRef, 0, len(userIds))
+	for _, userId := range userIds {
+		refs = append(refs, userRef{UserId: userId, Username: c.username(userId)})
+	}
+	return refs
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+// pagedUsersTestAPI serves users a page at a time, and counts the calls made.
+type pagedUsersTestAPI struct {
+	logOnlyAPI
+	users         []*model.User
+	getUserCalls  int
+	getUsersCalls int
+}
+
+func (api *pagedUsersTestAPI) GetUser(userId string) (*model.User, *model.AppError) {
+	api.getUserCalls++
+	for _, user := range api.users {
+		if user.Id == userId {
+			return user, nil
+		}
+	}
+	return nil, model.NewAppError("GetUser", "not_found", nil, "", 404)
+}
+
+func (api *pagedUsersTestAPI) GetUsers(options *model.UserGetOptions) ([]*model.User, *model.AppError) {
+	api.getUsersCalls++
+	start := options.Page * options.PerPage
+	if start > len(api.users) {
+		start = len(api.users)
+	}
+	end := start + options.PerPage
+	if end > len(api.users) {
+		end = len(api.users)
+	}
+	return api.users[start:end], nil
+}
+
+func TestUsernameCacheLoad(t *testing.T) {
+	api := &pagedUsersTestAPI{}
+	userIds := []string{}
+	for i := 0; i < 2*usernamePageSize; i++ {
+		id := fmt.Sprintf("user%d", i)
+		api.users = append(api.users, &model.User{Id: id, Username: "name-" + id})
+		userIds = append(userIds, id)
+	}
+	p := &Plugin{}
+	p.SetAPI(api)
+
+	refs := p.newUsernameCache().refs(append(userIds, "gone"))
+	if api.getUserCalls != 0 || api.getUsersCalls != 3 {
+		t.Logf("expected 3 pages and no single lookups, got %d pages and %d lookups", api.getUsersCalls, api.getUserCalls)
+		t.Fail()
+	}
+	if refs[1].Username != "name-user1" || refs[len(refs)-1].Username != "" {
+		t.Logf("unexpected usernames %v", refs)
+		t.Fail()
+	}
+
+	api.getUsersCalls = 0
+	p.newUsernameCache().refs(userIds[:usernameBatchThreshold])
+	if api.getUsersCalls != 0 || api.getUserCalls != usernameBatchThreshold {
+		t.Logf("expected single lookups for few users, got %d pages and %d lookups", api.getUsersCalls, api.getUserCalls)
+		t.Fail()
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+)
+
+// vCard lines longer than this many octets are folded (RFC 6350 section 3.2)
+const vCardMaxLineLength = 75
+
+var vCardEscaper = strings.NewReplacer(`\`, `\\`, ",", `\,`, ";", `\;`, "\r\n", `\n`, "\n", `\n`)
+
+// vCardText escapes the components of a property value and joins them with semicolons.
+func vCardText(components ...string) string {
+	escaped := make([]string, 0, len(components))
+	for _, component := range components {
+		escaped = append(escaped, vCardEscaper.Replace(component))
+	}
+	return strings.Join(escaped, ";")
+}
+
+// foldVCardLine splits a content line into lines of at most vCardMaxLineLength octets,
+// without splitting a UTF-8 character, each continuation line starting with a space.
+func foldVCardLine(line string) string {
+	var folded strings.Builder
+	limit := vCardMaxLineLength
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		folded.WriteString(line[:cut] + "\r\n ")
+		line = line[cut:]
+		limit = vCardMaxLineLength - 1 // after the leading space
+	}
+	folded.WriteString(line + "\r\n")
+	return folded.String()
+}
+
+// vCard returns an RFC 6350 vCard for the user. Fields that are empty, such as those the
+// viewer cannot see, are left out; the formatted name, which is required, falls back to
+// the username.
+func vCard(user User, username string, company string) string {
+	lines := []string{"BEGIN:VCARD", "VERSION:4.0"}
+	add := func(property string, value string) {
+		lines = append(lines, property+":"+value)
+	}
+
+	fullName := strings.TrimSpace(user.FirstName + " " + user.LastName)
+	if fullName == "" {
+		fullName = username
+	}
+	add("FN", vCardText(fullName))
+	if user.FirstName != "" || user.LastName != "" {
+		add("N", vCardText(user.LastName, user.FirstName, "", "", ""))
+	}
+	if user.Nickname != "" {
+		add("NICKNAME", vCardText(user.Nickname))
+	}
+	if user.JobTitle != "" {
+		add("TITLE", vCardText(user.JobTitle))
+	}
+	if company != "" || user.Department != "" {
+		add("ORG", vCardText(company, user.Department))
+	}
+	if user.Phone != "" {
+		add("TEL;TYPE=work,voice;VALUE=text", vCardText(user.Phone))
+	}
+	if user.Email != "" {
+		add("EMAIL;TYPE=work", vCardText(user.Email))
+	}
+	if user.Location != "" {
+		// Pingboard only gives the name of the office, which goes in the extended address
+		add("ADR;TYPE=work", vCardText("", user.Location, "", "", "", "", ""))
+	}
+	if user.Url != "" {
+		add("URL", user.Url)
+	}
+	lines = append(lines, "END:VCARD")
+
+	var card strings.Builder
+	for _, line := range lines {
+		card.WriteString(foldVCardLine(line))
+	}
+	return card.String()
+}
+
+// handleGetVCard returns the user's data as a vCard, to add them to an address book.
+func (p *Plugin) handleGetVCard(w http.ResponseWriter, r *http.Request) {
+	dir, userId, user, ok := p.lookupUser(w, r, p.newViewer(r))
+	if !ok {
+		return
+	}
+	company := ""
+	if dir.pingboardData != nil && dir.pingboardData.company != nil {
+		company = dir.pingboardData.company.Name
+	}
+	username := p.newUsernameCache().username(userId)
+	if username == "" {
+		username = userId
+	}
+
+	p.auditLookups(r, map[string]User{userId: user})
+	w.Header().Set("Content-Type", "text/vcard; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", username+".vcf"))
+	p.API.LogDebug("Returning vCard for " + userId)
+	if _, err := w.Write([]byte(vCard(user, username, company))); err != nil {
+		p.API.LogError("Failed to write vCard", "error", err)
+	}
+}
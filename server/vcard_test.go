@@ -0,0 +1,57 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVCard(t *testing.T) {
+	user := User{
+		FirstName:  "Alice",
+		LastName:   "Smith",
+		JobTitle:   "Trader, Rates; EMEA",
+		Department: "Trading",
+		Phone:      "+31 20 123 4567",
+		Email:      "alice@example.com",
+		Location:   "Amsterdam",
+		Url:        "https://imc.pingboard.com/users/1",
+	}
+	expected := "BEGIN:VCARD\r\n" +
+		"VERSION:4.0\r\n" +
+		"FN:Alice Smith\r\n" +
+		"N:Smith;Alice;;;\r\n" +
+		"TITLE:Trader\\, Rates\\; EMEA\r\n" +
+		"ORG:IMC;Trading\r\n" +
+		"TEL;TYPE=work,voice;VALUE=text:+31 20 123 4567\r\n" +
+		"EMAIL;TYPE=work:alice@example.com\r\n" +
+		"ADR;TYPE=work:;Amsterdam;;;;;\r\n" +
+		"URL:https://imc.pingboard.com/users/1\r\n" +
+		"END:VCARD\r\n"
+
+	if card := vCard(user, "alice", "IMC"); card != expected {
+		t.Logf("expected:\n%s\ngot:\n%s", expected, card)
+		t.Fail()
+	}
+
+	// Without a visible name, the username is used
+	if card := vCard(User{}, "alice", ""); !strings.Contains(card, "\r\nFN:alice\r\n") || strings.Contains(card, "\r\nN:") {
+		t.Logf("expected FN from username and no N, got:\n%s", card)
+		t.Fail()
+	}
+}
+
+func TestFoldVCardLine(t *testing.T) {
+	line := "NOTE:" + strings.Repeat("é", 60)
+	folded := foldVCardLine(line)
+
+	for _, part := range strings.Split(strings.TrimSuffix(folded, "\r\n"), "\r\n") {
+		if len(part) > vCardMaxLineLength {
+			t.Logf("line longer than %d octets: %q", vCardMaxLineLength, part)
+			t.Fail()
+		}
+	}
+	if unfolded := strings.ReplaceAll(strings.TrimSuffix(folded, "\r\n"), "\r\n ", ""); unfolded != line {
+		t.Logf("expected unfolded line %q, got %q", line, unfolded)
+		t.Fail()
+	}
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/mattermost/mattermost/server/public/model"
+)
+
+// Who can see a field of another user's data
+const (
+	visibilityEveryone = "everyone" // including guests
+	visibilityMembers  = "members"  // everyone but guests
+	visibilityTeam     = "team"     // members who share a team with the user
+	visibilityManagers = "managers" // the user's managers, all the way up
+	visibilityAdmins   = "admins"   // system admins only
+)
+
+const defaultVisibility = visibilityMembers
+
+// Fields of the directory data whose visibility is configured separately
+const (
+	visibleFieldName       = "name" // including the Pingboard ID and link
+	visibleFieldJobTitle   = "job_title"
+	visibleFieldDepartment = "department"
+	visibleFieldLocation   = "location"
+	visibleFieldManager    = "manager" // and so also reports, chains and the org chart
+	visibleFieldStartDate  = "start_date"
+	visibleFieldPhone      = "phone"
+	visibleFieldEmail      = "email"
+)
+
+func (c *configuration) visibility(field string) string {
+	visibility := map[string]string{
+		visibleFieldName:       c.VisibilityName,
+		visibleFieldJobTitle:   c.VisibilityJobTitle,
+		visibleFieldDepartment: c.VisibilityDepartment,
+		visibleFieldLocation:   c.VisibilityLocation,
+		visibleFieldManager:    c.VisibilityManager,
+		visibleFieldStartDate:  c.VisibilityStartDate,
+		visibleFieldPhone:      c.VisibilityPhone,
+		visibleFieldEmail:      c.VisibilityEmail,
+	}[field]
+	if visibility == "" {
+		return defaultVisibility
+	}
+	return visibility
+}
+
+// viewer is the user making a request, used to decide which fields of other users'
+// data they can see. A viewer should only live as long as a single request.
+type viewer struct {
+	plugin        *Plugin
+	config        *configuration
+	userId        string
+	isAdmin       bool
+	isGuest       bool
+	teamsByUserId map[string]map[string]bool // looked up as needed, when not in the directory
+}
+
+func (p *Plugin) newViewer(r *http.Request) *viewer {
+	if isPluginRequest(r) {
+		// other plugins are trusted like system admins, and apply their own policies
+		return &viewer{plugin: p, config: p.getConfiguration(), isAdmin: true}
+	}
+	return p.newUserViewer(r.Header.Get("Mattermost-User-ID"))
+}
+
+func (p *Plugin) newUserViewer(userId string) *viewer {
+	v := &viewer{
+		plugin:        p,
+		config:        p.getConfiguration(),
+		userId:        userId,
+		isAdmin:       p.API.HasPermissionTo(userId, model.PermissionManageSystem),
+		isGuest:       true, // until shown otherwise
+		teamsByUserId: map[string]map[string]bool{},
+	}
+	if mmUser, appErr := p.API.GetUser(userId); appErr != nil {
+		p.API.LogError("Failed to get requesting mattermost user", "user_id", userId, "error", appErr)
+	} else {
+		v.isGuest = mmUser.IsGuest()
+	}
+	return v
+}
+
+// newChannelViewer returns a viewer who can only see what every member of the channel
+// can see: the fields visible to everyone, and those visible to members unless there are
+// guests in the channel (or the user posting is one).
+func (p *Plugin) newChannelViewer(channelId string, isGuest bool) *viewer {
+	if !isGuest {
+		if stats, appErr := p.API.GetChannelStats(channelId); appErr != nil {
+			p.API.LogError("Failed to get channel stats", "channel_id", channelId, "error", appErr)
+			isGuest = true
+		} else {
+			isGuest = stats.GuestCount > 0
+		}
+	}
+	return &viewer{
+		plugin:        p,
+		config:        p.getConfiguration(),
+		isGuest:       isGuest,
+		teamsByUserId: map[string]map[string]bool{"": {}}, // in no team, so sharing none
+	}
+}
+
+// teams returns the IDs of the user's teams. Other users' teams come from the directory
+// when it has them; the viewer's own are looked up once, so that they are current.
+func (v *viewer) teams(dir *directory, userId string) map[string]bool {
+	if teams, found := v.teamsByUserId[userId]; found {
+		return teams
+	}
+	if teams, found := dir.teamIdsByUserId[userId]; found && userId != v.userId {
+		return teams
+	}
+	teams := map[string]bool{}
+	if mmTeams, appErr := v.plugin.API.GetTeamsForUser(userId); appErr != nil {
+		v.plugin.API.LogWarn("Failed to get teams for mattermost user", "user_id", userId, "error", appErr)
+	} else {
+		for _, team := range mmTeams {
+			teams[team.Id] = true
+		}
+	}
+	v.teamsByUserId[userId] = teams
+	return teams
+}
+
+func (v *viewer) sharesTeamWith(dir *directory, userId string) bool {
+	ownTeams := v.teams(dir, v.userId)
+	if len(ownTeams) == 0 {
+		return false
+	}
+	theirTeams := v.teams(dir, userId)
+	for teamId := range ownTeams {
+		if theirTeams[teamId] {
+			return true
+		}
+	}
+	return false
+}
+
+// canSee returns whether the viewer can see the field of the given user's data.
+func (v *viewer) canSee(dir *directory, field string, userId string) bool {
+	if v.isAdmin || userId == v.userId {
+		return true
+	}
+	switch v.config.visibility(field) {
+	case visibilityEveryone:
+		return true
+	case visibilityMembers:
+		return !v.isGuest
+	case visibilityTeam:
+		return !v.isGuest && v.sharesTeamWith(dir, userId)
+	case visibilityManagers:
+		chain, _ := dir.managementChain(userId)
+		for _, managerId := range chain {
+			if managerId == v.userId {
+				return true
+			}
+		}
+		return false
+	default: // admins, or a setting this version does not know
+		return false
+	}
+}
+
+// filterUser clears the fields of the user's data that the viewer cannot see. Returns
+// false if they cannot see any of it, in which case the user should be treated as unknown.
+func (v *viewer) filterUser(dir *directory, userId string, user User) (User, bool) {
+	visible := false
+	show := func(field string) bool {
+		canSee := v.canSee(dir, field, userId)
+		visible = visible || canSee
+		return canSee
+	}
+
+	filtered := User{hasPingboardManager: user.hasPingboardManager}
+	if show(visibleFieldName) {
+		filtered.Id = user.Id
+		filtered.Url = user.Url
+		filtered.FirstName = user.FirstName
+		filtered.LastName = user.LastName
+		filtered.Nickname = user.Nickname
+	}
+	if show(visibleFieldJobTitle) {
+		filtered.JobTitle = user.JobTitle
+	}
+	if show(visibleFieldDepartment) {
+		filtered.Department = user.Department
+	}
+	if show(visibleFieldLocation) {
+		filtered.Location = user.Location
+	}
+	if show(visibleFieldManager) {
+		filtered.ManagerId = user.ManagerId
+		filtered.Manager = user.Manager
+	}
+	if show(visibleFieldStartDate) {
+		filtered.StartYear = user.StartYear
+		filtered.StartMonth = user.StartMonth
+		filtered.StartDay = user.StartDay
+	}
+	if show(visibleFieldPhone) {
+		filtered.Phone = user.Phone
+	}
+	if show(visibleFieldEmail) {
+		filtered.Email = user.Email
+	}
+	return filtered, visible
+}
+
+// canSeeReport returns whether the viewer can see that the user reports to their manager.
+func (v *viewer) canSeeReport(dir *directory, userId string) bool {
+	return v.canSee(dir, visibleFieldManager, userId)
+}
+
+// visibleChain returns the part of the user's management chain that the viewer can see,
+// which ends at the first manager whose own manager they cannot see.
+func (v *viewer) visibleChain(dir *directory, userId string, chain []string) []string {
+	visible := []string{}
+	for _, managerId := range chain {
+		if !v.canSeeReport(dir, userId) {
+			break
+		}
+		visible = append(visible, managerId)
+		userId = managerId
+	}
+	return visible
+}
+
+// visibleReports returns the user's direct and indirect reports that the viewer can see,
+// which are those reached only through reporting lines the viewer can see.
+func (v *viewer) visibleReports(dir *directory, userId string) (direct []string, indirect []string) {
+	direct = []string{}
+	indirect = []string{}
+	seen := map[string]bool{userId: true}
+	queue := []string{}
+	for _, report := range dir.directReports(userId) {
+		if v.canSeeReport(dir, report) {
+			seen[report] = true
+			direct = append(direct, report)
+			queue = append(queue, report)
+		}
+	}
+	for len(queue) > 0 {
+		next := queue[0]
+		queue = queue[1:]
+		for _, report := range dir.directReports(next) {
+			if seen[report] || !v.canSeeReport(dir, report) {
+				continue
+			}
+			seen[report] = true
+			indirect = append(indirect, report)
+			queue = append(queue, report)
+		}
+	}
+	return direct, indirect
+}
+
+// filterOrgChart removes the reports the viewer cannot see from the org chart, and
+// clears the fields of its nodes that they cannot see.
+func (v *viewer) filterOrgChart(dir *directory, node *orgChartNode) {
+	if !v.canSee(dir, visibleFieldJobTitle, node.UserId) {
+		node.JobTitle = ""
+	}
+	if !v.canSee(dir, visibleFieldDepartment, node.UserId) {
+		node.Department = ""
+	}
+	reports := []*orgChartNode{}
+	for _, report := range node.Reports {
+		if v.canSeeReport(dir, report.UserId) {
+			v.filterOrgChart(dir, report)
+			reports = append(reports, report)
+		}
+	}
+	node.Reports = reports
+	// only say reports were left out if the viewer could have seen them
+	node.Truncated = false
+	for _, userId := range node.truncatedIds {
+		if v.canSeeReport(dir, userId) {
+			node.Truncated = true
+			break
+		}
+	}
+}
+
+// filterUserIds returns the users for whom the viewer can see all of the given fields.
+func (v *viewer) filterUserIds(dir *directory, userIds []string, fields ...string) []string {
+	visible := []string{}
+	for _, userId := range userIds {
+		canSee := true
+		for _, field := range fields {
+			canSee = canSee && v.canSee(dir, field, userId)
+		}
+		if canSee {
+			visible = append(visible, userId)
+		}
+	}
+	return visible
+}
+
+// departmentHead returns the head of the department, or nil if the viewer cannot see
+// their department.
+func (v *viewer) departmentHead(dir *directory, dept *department, usernames *usernameCache) *userRef {
+	if !v.canSee(dir, visibleFieldDepartment, dept.headId) {
+		return nil
+	}
+	return &usernames.refs([]string{dept.headId})[0]
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/mattermost/mattermost/server/public/model"
+	"github.com/mattermost/mattermost/server/public/plugin/plugintest"
+)
+
+func TestCanSee(t *testing.T) {
+	dir := testDirectory(map[string]string{"alice": "", "bob": "alice", "carol": "bob", "dave": ""})
+	for name, tc := range map[string]struct {
+		visibility string
+		viewer     viewer
+		userId     string
+		expected   bool
+	}{
+		"everyone, guest": {
+			visibility: visibilityEveryone,
+			viewer:     viewer{userId: "dave", isGuest: true},
+			userId:     "carol",
+			expected:   true,
+		},
+		"members, member": {
+			visibility: visibilityMembers,
+			viewer:     viewer{userId: "dave"},
+			userId:     "carol",
+			expected:   true,
+		},
+		"members, guest": {
+			visibility: visibilityMembers,
+			viewer:     viewer{userId: "dave", isGuest: true},
+			userId:     "carol",
+			expected:   false,
+		},
+		"managers, manager's manager": {
+			visibility: visibilityManagers,
+			viewer:     viewer{userId: "alice"},
+			userId:     "carol",
+			expected:   true,
+		},
+		"managers, report": {
+			visibility: visibilityManagers,
+			viewer:     viewer{userId: "carol"},
+			userId:     "bob",
+			expected:   false,
+		},
+		"admins, member": {
+			visibility: visibilityAdmins,
+			viewer:     viewer{userId: "dave"},
+			userId:     "carol",
+			expected:   false,
+		},
+		"admins, admin": {
+			visibility: visibilityAdmins,
+			viewer:     viewer{userId: "dave", isAdmin: true},
+			userId:     "carol",
+			expected:   true,
+		},
+		"admins, self": {
+			visibility: visibilityAdmins,
+			viewer:     viewer{userId: "carol"},
+			userId:     "carol",
+			expected:   true,
+		},
+		"unknown setting": {
+			visibility: "nobody",
+			viewer:     viewer{userId: "dave"},
+			userId:     "carol",
+			expected:   false,
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			v := tc.viewer
+			v.config = &configuration{VisibilityPhone: tc.visibility}
+
+			if canSee := v.canSee(dir, visibleFieldPhone, tc.userId); canSee != tc.expected {
+				t.Logf("expected: %v, got %v", tc.expected, canSee)
+				t.Fail()
+			}
+		})
+	}
+}
+
+func TestFilterUser(t *testing.T) {
+	dir := testDirectory(map[string]string{"alice": ""})
+	user := User{FirstName: "Alice", Phone: "123", Email: "alice@example.com"}
+
+	v := &viewer{userId: "bob", config: &configuration{
+		VisibilityName:       visibilityMembers,
+		VisibilityJobTitle:   visibilityAdmins,
+		VisibilityDepartment: visibilityAdmins,
+		VisibilityLocation:   visibilityAdmins,
+		VisibilityManager:    visibilityAdmins,
+		VisibilityStartDate:  visibilityAdmins,
+		VisibilityPhone:      visibilityAdmins,
+	}}
+	filtered, visible := v.filterUser(dir, "alice", user)
+	if expected := (User{FirstName: "Alice", Email: "alice@example.com"}); !visible || filtered != expected {
+		t.Logf("expected: %+v, got %+v (visible %v)", expected, filtered, visible)
+		t.Fail()
+	}
+
+	v.isGuest = true
+	if _, visible := v.filterUser(dir, "alice", user); visible {
+		t.Log("expected nothing to be visible to a guest")
+		t.Fail()
+	}
+}
+
+func TestVisibleReports(t *testing.T) {
+	// bob can see who reports to him and his own manager, but not that dave reports to alice
+	dir := testDirectory(map[string]string{"alice": "", "bob": "alice", "carol": "bob", "dave": "alice", "erin": "dave"})
+	v := &viewer{userId: "bob", config: &configuration{VisibilityManager: visibilityManagers}}
+
+	direct, indirect := v.visibleReports(dir, "alice")
+	if !reflect.DeepEqual(direct, []string{"bob"}) || !reflect.DeepEqual(indirect, []string{"carol"}) {
+		t.Logf("expected direct reports [bob] and indirect reports [carol], got %v and %v", direct, indirect)
+		t.Fail()
+	}
+	if chain := v.visibleChain(dir, "carol", []string{"bob", "alice"}); !reflect.DeepEqual(chain, []string{"bob", "alice"}) {
+		t.Logf("expected chain [bob alice], got %v", chain)
+		t.Fail()
+	}
+	if chain := v.visibleChain(dir, "erin", []string{"dave", "alice"}); !reflect.DeepEqual(chain, []string{}) {
+		t.Logf("expected empty chain, got %v", chain)
+		t.Fail()
+	}
+}
+
+func TestFilterOrgChartTruncated(t *testing.T) {
+	// bob can see who reports to him, but not that dave reports to alice
+	dir := testDirectory(map[string]string{"alice": "", "bob": "alice", "carol": "bob", "dave": "alice"})
+	v := &viewer{userId: "bob", config: &configuration{VisibilityManager: visibilityManagers}}
+
+	node := dir.orgChart("alice", 2)
+	v.filterOrgChart(dir, node)
+	if node.Truncated || len(node.Reports) != 1 || !node.Reports[0].Truncated {
+		t.Logf("expected only bob's node to be truncated, got %+v", node)
+		t.Fail()
+	}
+
+	node = dir.orgChart("alice", 1)
+	v.filterOrgChart(dir, node)
+	if !node.Truncated {
+		t.Log("expected alice's node to be truncated, since bob is visible below the limit")
+		t.Fail()
+	}
+
+	v.userId = "carol"
+	node = dir.orgChart("alice", 1)
+	v.filterOrgChart(dir, node)
+	if node.Truncated {
+		t.Log("expected no truncation when only hidden reports were left out")
+		t.Fail()
+	}
+}
+
+func TestTeamVisibility(t *testing.T) {
+	dir := testDirectory(map[string]string{"alice": "", "bob": "alice", "carol": "alice", "dave": "", "erin": ""})
+	dir.teamIdsByUserId = map[string]map[string]bool{
+		"alice": {"sales": true, "trading": true},
+		"bob":   {"sales": true},
+		"carol": {"tech": true},
+		"dave":  {"tech": true}, // the index is out of date for the viewer
+	}
+	api := &plugintest.API{}
+	// only the viewer, and users matched since the refresh, are looked up
+	api.On("GetTeamsForUser", "dave").Return([]*model.Team{{Id: "sales"}}, nil).Once()
+	api.On("GetTeamsForUser", "erin").Return([]*model.Team{{Id: "sales"}}, nil).Once()
+	p := &Plugin{}
+	p.SetAPI(api)
+	v := &viewer{plugin: p, userId: "dave", config: &configuration{VisibilityJobTitle: visibilityTeam},
+		teamsByUserId: map[string]map[string]bool{}}
+
+	for userId, expected := range map[string]bool{"alice": true, "bob": true, "carol": false, "erin": true} {
+		if canSee := v.canSee(dir, visibleFieldJobTitle, userId); canSee != expected {
+			t.Logf("%s: expected %v, got %v", userId, expected, canSee)
+			t.Fail()
+		}
+	}
+	api.AssertExpectations(t)
+}
@@ -5,7 +5,7 @@ import manifest from '@/manifest';
 
 export default class Client {
     getPingboardInfo = async (username = '') => {
-        const url = `/plugins/${manifest.id}/user?username=` + username;
+        const url = `/plugins/${manifest.id}/api/v1/user?username=` + username;
         const response = await fetch(url, Client4.getOptions({
             method: 'get',
         }));
@@ -49,6 +49,9 @@ export default class UserAttribute extends React.PureComponent {
                 <div key={`${manifest.id}_link`}>
                     {messageHtmlToComponent(`↪ <a href=${pingboardInfo.url} target="_blank">Pingboard profile</a>`)}
                 </div>
+                <div key={`${manifest.id}_vcard`}>
+                    {messageHtmlToComponent(`📇 <a href="/plugins/${manifest.id}/api/v1/user/vcard?username=${encodeURIComponent(this.props.username)}" download>Add to contacts</a>`)}
+                </div>
             </div>
         );
     }